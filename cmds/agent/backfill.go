@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+	"github.com/lsg2020/logfilter/tailer"
+)
+
+// backfill reads the existing lines of a file entry once for a backfill job, its records
+// go through the queue like the tailed ones but never move the checkpoint.
+type backfill struct {
+	job       *define.BackfillJob
+	logger    logger.Log
+	out       *queue
+	pipeline  *tailer.Pipeline
+	timestamp *tailer.Timestamp
+	status    *define.AgentJobStatus
+
+	// time of the last record with a timestamp, the following lines without one share it
+	last    time.Time
+	hasLast bool
+}
+
+// Backfill starts a backfill job, the job status follows its last record.
+func (c *collector) Backfill(ctx context.Context, job *define.BackfillJob) {
+	b := &backfill{
+		job:    job,
+		logger: c.logger,
+		out:    c.out,
+		status: &define.AgentJobStatus{ID: job.ID},
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.logger.Log(logger.LogLevelInfo, "backfill %s start %s", job.ID, job.File.Key())
+		err := b.run(ctx)
+		if err != nil {
+			b.status.Error = err.Error()
+			c.logger.Log(logger.LogLevelError, "backfill %s failed, %v", job.ID, err)
+		}
+		c.logger.Log(logger.LogLevelInfo, "backfill %s finish files %d lines %d filtered %d", job.ID, b.status.Files, b.status.Lines, b.status.Filtered)
+		b.out.Push(ctx, &record{file: job.File, job: job.ID, status: b.status})
+	}()
+}
+
+func (b *backfill) run(ctx context.Context) error {
+	file := b.job.File
+	var err error
+	if b.pipeline, err = tailer.NewPipeline(file); err != nil {
+		return err
+	}
+	if b.job.TimeRange() {
+		timestamp := b.job.Timestamp
+		if timestamp == nil {
+			timestamp = file.Timestamp
+		}
+		if timestamp == nil {
+			return fmt.Errorf("time range needs a timestamp config")
+		}
+		if b.timestamp, err = tailer.NewTimestamp(timestamp); err != nil {
+			return err
+		}
+	}
+
+	paths, err := b.paths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := b.scan(ctx, path); err != nil {
+			return fmt.Errorf("backfill %s failed, %w", path, err)
+		}
+		b.status.Files++
+	}
+	return nil
+}
+
+// paths lists the files of the job, a given path has to be one of the entry files or
+// their rotated siblings.
+func (b *backfill) paths() ([]string, error) {
+	matches, err := tailer.Match(b.job.File.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, match := range matches {
+		if b.job.Rotated || b.job.Path != "" {
+			rotated, err := tailer.Rotated(match)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, rotated...)
+		}
+		if _, err := os.Stat(match); err == nil {
+			paths = append(paths, match)
+		}
+	}
+	if b.job.Path == "" {
+		return paths, nil
+	}
+	for _, path := range paths {
+		if path == b.job.Path {
+			return []string{path}, nil
+		}
+	}
+	return nil, fmt.Errorf("path %s is not a file of %s", b.job.Path, b.job.File.Key())
+}
+
+// scan runs the lines of a file through the pipeline of the entry, the same way the
+// tailed lines go.
+func (b *backfill) scan(ctx context.Context, path string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b.hasLast = false
+
+	in := make(chan *tailer.Line)
+	done := make(chan struct{})
+	var emitErr error
+	go func() {
+		defer close(done)
+		b.pipeline.Run(ctx, in, func(line *tailer.Line, dropped bool) bool {
+			if emitErr = b.emit(ctx, line, dropped); emitErr != nil {
+				cancel()
+				return false
+			}
+			return true
+		})
+	}()
+
+	err := tailer.Scan(ctx, tailer.ScanConfig{
+		Path:        path,
+		FromOffset:  b.job.FromOffset,
+		ToOffset:    b.job.ToOffset,
+		FromLine:    b.job.FromLine,
+		ToLine:      b.job.ToLine,
+		MaxLineSize: b.pipeline.MaxLineSize(),
+	}, func(line *tailer.Line) error {
+		select {
+		case in <- line:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(in)
+	<-done
+	if emitErr != nil {
+		return emitErr
+	}
+	return err
+}
+
+func (b *backfill) emit(ctx context.Context, line *tailer.Line, dropped bool) error {
+	if b.timestamp != nil {
+		if t, ok := b.timestamp.Parse(line.Text); ok {
+			b.last, b.hasLast = t, true
+		}
+		if !b.hasLast || (!b.job.Since.IsZero() && b.last.Before(b.job.Since)) ||
+			(!b.job.Until.IsZero() && !b.last.Before(b.job.Until)) {
+			return nil
+		}
+	}
+	if dropped {
+		b.status.Filtered++
+		return nil
+	}
+	if !b.out.Push(ctx, &record{file: b.job.File, line: line, job: b.job.ID}) {
+		return ctx.Err()
+	}
+	b.status.Lines++
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+func TestBackfill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.log")
+	data := "[1 INFO start\n[2 ERROR failed\n  at main\n\n[3 ERROR again"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := &define.AgentFile{
+		Target:     "t",
+		Name:       "n",
+		Path:       path,
+		Multiline:  &define.ConfigMultiline{Start: `^\[`},
+		Prefilters: []*define.ConfigPrefilter{{Levels: []string{"error"}}},
+	}
+	b := &backfill{
+		job:    &define.BackfillJob{ID: "j", File: file},
+		out:    newQueue(16),
+		status: &define.AgentJobStatus{ID: "j"},
+	}
+	if err := b.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []string
+	for len(b.out.Jobs) > 0 {
+		records = append(records, (<-b.out.Jobs).line.Text)
+	}
+	if want := []string{"[2 ERROR failed\n  at main", "[3 ERROR again"}; !reflect.DeepEqual(records, want) {
+		t.Errorf("records %q, want %q", records, want)
+	}
+	if b.status.Files != 1 || b.status.Lines != 2 || b.status.Filtered != 1 {
+		t.Errorf("status %+v", b.status)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/lsg2020/logfilter/tailer"
+)
+
+// positions are the read positions of the log files of each file entry, keyed by
+// the entry key and then the file path.
+type positions map[string]map[string]tailer.Position
+
+func (p positions) Set(key string, path string, pos tailer.Position) {
+	files := p[key]
+	if files == nil {
+		files = make(map[string]tailer.Position)
+		p[key] = files
+	}
+	files[path] = pos
+}
+
+func (p positions) Merge(other positions) {
+	for key, files := range other {
+		if p[key] == nil {
+			p[key] = make(map[string]tailer.Position, len(files))
+		}
+		for path, pos := range files {
+			p.Set(key, path, pos)
+		}
+	}
+}
+
+// checkpoint is the file positions the manager has acknowledged, the agent resumes
+// from them after a restart.
+type checkpoint struct {
+	path string
+
+	Files positions `json:"files"`
+	Time  time.Time `json:"time"`
+	// Seq is the last record sequence the manager has acknowledged
+	Seq uint64 `json:"seq"`
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{path: path}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint failed, %w", err)
+	}
+	if err := json.Unmarshal(buf, cp); err != nil {
+		return nil, fmt.Errorf("checkpoint unmarshal failed, %s %w", string(buf), err)
+	}
+	return cp, nil
+}
+
+func (cp *checkpoint) Save(pos positions, seq uint64) error {
+	if cp.Files == nil {
+		cp.Files = make(positions)
+	}
+	cp.Files.Merge(pos)
+	if seq > cp.Seq {
+		cp.Seq = seq
+	}
+	cp.Time = time.Now()
+
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("checkpoint marshal failed, %w", err)
+	}
+
+	tmpPath := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return fmt.Errorf("write checkpoint failed, %w", err)
+	}
+	if err := os.Rename(tmpPath, cp.path); err != nil {
+		return fmt.Errorf("rename checkpoint failed, %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lsg2020/logfilter/tailer"
+)
+
+func TestPositionsMerge(t *testing.T) {
+	p := positions{}
+	p.Set("t/a", "/log/a.log", tailer.Position{Inode: 1, Offset: 10})
+	p.Set("t/a", "/log/a.log.1", tailer.Position{Inode: 2, Offset: 20})
+
+	p.Merge(positions{
+		"t/a": {"/log/a.log": {Inode: 1, Offset: 15}},
+		"t/b": {"/log/b.log": {Inode: 3, Offset: 5}},
+	})
+	want := positions{
+		"t/a": {
+			"/log/a.log":   {Inode: 1, Offset: 15},
+			"/log/a.log.1": {Inode: 2, Offset: 20},
+		},
+		"t/b": {"/log/b.log": {Inode: 3, Offset: 5}},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("merged %v, want %v", p, want)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	cp, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Files) != 0 || cp.Seq != 0 || !cp.Time.IsZero() {
+		t.Fatalf("new checkpoint %+v", cp)
+	}
+
+	tests := []struct {
+		pos  positions
+		seq  uint64
+		want positions
+		// the acked sequence never moves back
+		wantSeq uint64
+	}{
+		{
+			pos:     positions{"t/a": {"a.log": {Inode: 1, Offset: 10}}},
+			seq:     5,
+			want:    positions{"t/a": {"a.log": {Inode: 1, Offset: 10}}},
+			wantSeq: 5,
+		},
+		{
+			pos: positions{"t/b": {"b.log": {Inode: 2, Offset: 7}}},
+			seq: 3,
+			want: positions{
+				"t/a": {"a.log": {Inode: 1, Offset: 10}},
+				"t/b": {"b.log": {Inode: 2, Offset: 7}},
+			},
+			wantSeq: 5,
+		},
+		{
+			pos: positions{"t/a": {"a.log": {Inode: 1, Offset: 30}}},
+			seq: 9,
+			want: positions{
+				"t/a": {"a.log": {Inode: 1, Offset: 30}},
+				"t/b": {"b.log": {Inode: 2, Offset: 7}},
+			},
+			wantSeq: 9,
+		},
+	}
+	for i, tt := range tests {
+		if err := cp.Save(tt.pos, tt.seq); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadCheckpoint(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded.Files, tt.want) || loaded.Seq != tt.wantSeq || loaded.Time.IsZero() {
+			t.Errorf("save %d loaded %v seq:%d, want %v seq:%d", i, loaded.Files, loaded.Seq, tt.want, tt.wantSeq)
+		}
+	}
+}
+
+func TestCheckpointCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCheckpoint(path); err == nil {
+		t.Error("corrupt checkpoint loaded")
+	}
+}
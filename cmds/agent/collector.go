@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+	"github.com/lsg2020/logfilter/tailer"
+)
+
+// record is a log event of one configured file entry, a dropped record is only counted.
+// A backfill job record carries the job id, the last one of a job only its status.
+type record struct {
+	file    *define.AgentFile
+	line    *tailer.Line
+	dropped bool
+	job     string
+	status  *define.AgentJobStatus
+}
+
+// collector runs a follower and a pipeline for every file entry of the agent, the
+// entries change when the manager pushes a new config.
+type collector struct {
+	logger  logger.Log
+	out     *queue
+	entries *tailer.Entries
+
+	// the backfill jobs
+	wg sync.WaitGroup
+}
+
+func newCollector(l logger.Log, since time.Time, resume positions, out *queue) *collector {
+	c := &collector{
+		logger: l,
+		out:    out,
+	}
+	c.entries = tailer.NewEntries(tailer.EntriesConfig{
+		Name:   "collector",
+		Since:  since,
+		Logger: l,
+		Emit: func(ctx context.Context, file *define.AgentFile, line *tailer.Line, dropped bool) bool {
+			return out.Push(ctx, &record{file: file, line: line, dropped: dropped})
+		},
+		OnRotate: out.Rotated,
+	}, resume)
+	return c
+}
+
+// Update starts the new file entries and stops the removed ones, a changed entry is
+// restarted from the position it has reached.
+func (c *collector) Update(ctx context.Context, files []*define.AgentFile) {
+	c.entries.Update(ctx, files)
+}
+
+func (c *collector) Wait() {
+	c.entries.Wait()
+	c.wg.Wait()
+}
+
+// States reports the read positions and line counts of the running entries.
+func (c *collector) States() []*define.AgentFileState {
+	return c.entries.States(c.out.Dropped)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	defaultEnrollTimeout = time.Second * 10
+	// the manager may be down or the files of the agent not configured yet
+	defaultEnrollRetry = time.Second * 30
+)
+
+// enroll registers an agent installed on its host with the manager, it gets the params an
+// agent started over ssh gets on its stdin. A refused token is not retried.
+func enroll(l logger.Log, manager string, token string, name string, tlsConfig *tls.Config) (*define.AgentParams, error) {
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("get hostname failed, %w", err)
+		}
+		name = hostname
+	}
+	body, err := json.Marshal(&define.EnrollRequest{
+		Name:     name,
+		Token:    token,
+		Version:  define.Version,
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal enroll request failed, %w", err)
+	}
+
+	url := strings.TrimRight(manager, "/") + "/enroll"
+	client := &http.Client{Timeout: defaultEnrollTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	for {
+		params, retry, err := enrollOnce(client, url, body)
+		if err == nil {
+			l.Log(logger.LogLevelInfo, "agent enrolled, name:%s files:%d", name, len(params.Files))
+			return params, nil
+		}
+		if !retry {
+			return nil, err
+		}
+		l.Log(logger.LogLevelWarning, "agent enroll failed, name:%s retry in %v. %v", name, defaultEnrollRetry, err)
+		time.Sleep(defaultEnrollRetry)
+	}
+}
+
+func enrollOnce(client *http.Client, url string, body []byte) (*define.AgentParams, bool, error) {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, true, fmt.Errorf("post enroll request failed, %w", err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("read enroll response failed, %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusBadRequest:
+		return nil, false, fmt.Errorf("enroll refused, %s", strings.TrimSpace(string(buf)))
+	default:
+		return nil, true, fmt.Errorf("enroll failed, %s %s", resp.Status, strings.TrimSpace(string(buf)))
+	}
+
+	params := &define.AgentParams{}
+	if err := json.Unmarshal(buf, params); err != nil {
+		return nil, true, fmt.Errorf("unmarshal enroll response failed, %w", err)
+	}
+	return params, false, nil
+}
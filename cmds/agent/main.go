@@ -1,19 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/lsg2020/logfilter/define"
 	"github.com/lsg2020/logfilter/logger"
-	"github.com/nxadm/tail"
+	"github.com/lsg2020/logfilter/tailer"
+)
+
+const (
+	defaultStateDir = ".logfilter"
+)
+
+// an agent installed on its host enrolls with the manager instead of getting its params
+// on stdin
+var (
+	managerURL  = flag.String("manager", "", "manager url to enroll with, like http://manager:8080")
+	enrollToken = flag.String("token", "", "enroll token")
+	agentName   = flag.String("name", "", "agent name of the files in the target config, the hostname by default")
+	stateDir    = flag.String("state_dir", "", "state dir, .logfilter by default")
+	caFile      = flag.String("ca", "", "ca file to verify a https manager with, the system roots by default")
+	certFile    = flag.String("cert", "", "client certificate file for a manager with mutual tls")
+	keyFile     = flag.String("key", "", "client key file for a manager with mutual tls")
 )
 
 func main() {
@@ -21,71 +45,167 @@ func main() {
 	if err != nil {
 		log.Fatalln("init logger failed", err)
 	}
-	if len(os.Args) <= 1 {
-		log.Fatalln("need input params")
-	}
+	flag.Parse()
+
+	// keep running when the ssh session that started the agent goes away, unless the
+	// params tell to exit with it
+	signal.Ignore(syscall.SIGPIPE, syscall.SIGHUP)
 
-	l.Log(logger.LogLevelInfo, "start agent %v", os.Args)
+	ca, err := readCA(*caFile)
+	if err != nil {
+		l.Log(logger.LogLevelError, "load tls config failed, %v", err)
+		return
+	}
 	params := &define.AgentParams{}
-	err = params.FromString(os.Args[1])
+	var stdin *bufio.Reader
+	if *managerURL != "" {
+		tlsConfig, err := clientTLSConfig(ca, *certFile, *keyFile)
+		if err != nil {
+			l.Log(logger.LogLevelError, "load tls config failed, %v", err)
+			return
+		}
+		params, err = enroll(l, *managerURL, *enrollToken, *agentName, tlsConfig)
+		if err != nil {
+			l.Log(logger.LogLevelError, "enroll failed, %v", err)
+			return
+		}
+	} else {
+		// the params carry the token, they come on stdin to stay out of the process list
+		str := flag.Arg(0)
+		if str == "" {
+			stdin = bufio.NewReader(os.Stdin)
+			str, err = stdin.ReadString('\n')
+			if err != nil && (err != io.EOF || str == "") {
+				l.Log(logger.LogLevelError, "read params failed, %v", err)
+				return
+			}
+		}
+		err = params.FromString(strings.TrimSpace(str))
+		if err != nil {
+			l.Log(logger.LogLevelError, "parse param failed, %v", err)
+			return
+		}
+	}
+	l.Log(logger.LogLevelInfo, "start agent %s files:%d", params.WebSocketAddr, len(params.Files))
+
+	// the ca of the command line goes before the one the manager hands out
+	if len(ca) == 0 {
+		ca = []byte(params.CACert)
+	}
+	tlsConfig, err := clientTLSConfig(ca, *certFile, *keyFile)
+	if err != nil {
+		l.Log(logger.LogLevelError, "load tls config failed, %v", err)
+		return
+	}
+
+	if *stateDir != "" {
+		params.StateDir = *stateDir
+	}
+	if params.StateDir == "" {
+		params.StateDir = defaultStateDir
+	}
+	if err := os.MkdirAll(params.StateDir, 0700); err != nil {
+		l.Log(logger.LogLevelError, "create state dir failed, %v", err)
+		return
+	}
+	lock, err := lockStateDir(filepath.Join(params.StateDir, "lock"))
 	if err != nil {
-		l.Log(logger.LogLevelError, "parse param failed, %v", err)
+		l.Log(logger.LogLevelError, "lock state dir failed, %v", err)
 		return
 	}
-	l.Log(logger.LogLevelInfo, "start agent %v", params)
+	defer lock.Close()
 
-	l.Log(logger.LogLevelInfo, "start tail")
-	tail, err := tail.TailFile(params.LogPath, tail.Config{
-		ReOpen:    true,
-		Follow:    true,
-		Location:  &tail.SeekInfo{Offset: 0, Whence: 2},
-		MustExist: false,
-		Poll:      true,
-	})
+	sp, err := newSpool(filepath.Join(params.StateDir, "spool"), params.SpoolMaxSize)
 	if err != nil {
-		l.Log(logger.LogLevelError, "open log file failed, %v", err)
+		l.Log(logger.LogLevelError, "open spool failed, %v", err)
+		return
+	}
+	cp, err := loadCheckpoint(filepath.Join(params.StateDir, "checkpoint"))
+	if err != nil {
+		l.Log(logger.LogLevelError, "load checkpoint failed, %v", err)
 		return
 	}
 
-	l.Log(logger.LogLevelInfo, "start connect websocket")
-	connCtx, connCancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer connCancel()
-	conn, _, err := websocket.DefaultDialer.DialContext(connCtx, params.WebSocketAddr, nil)
+	for _, file := range params.Files {
+		if file.Multiline != nil {
+			if _, err := tailer.NewMultiline(file.Multiline); err != nil {
+				l.Log(logger.LogLevelError, "invalid multiline config of %s, %v", file.Key(), err)
+				return
+			}
+		}
+	}
+	// forget the files and entries that are gone since the last run
+	if err := pruneCheckpoint(cp, params.Files); err != nil {
+		l.Log(logger.LogLevelError, "match log path failed, %v", err)
+		return
+	}
+
+	// lines already in the spool are not read again
+	resume := make(positions)
+	resume.Merge(cp.Files)
+	batches, err := sp.Load()
 	if err != nil {
-		l.Log(logger.LogLevelError, "websocket connect error, %v", err)
+		l.Log(logger.LogLevelError, "load spool failed, %v", err)
 		return
 	}
-	defer conn.Close()
+	for _, b := range batches {
+		resume.Merge(b.Files)
+		// the spooled records keep their sequence, the new ones follow them
+		if n := len(b.Records); n > 0 && b.Records[n-1].Seq > cp.Seq {
+			cp.Seq = b.Records[n-1].Seq
+		}
+	}
+	// the entries of an earlier run read the files created since then from the start
+	if !cp.Time.IsZero() {
+		for _, file := range params.Files {
+			if resume[file.Key()] == nil {
+				resume[file.Key()] = make(map[string]tailer.Position)
+			}
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		l.Log(logger.LogLevelError, "get hostname failed, %v", err)
+	}
+	checksum, err := binaryChecksum()
+	if err != nil {
+		l.Log(logger.LogLevelError, "checksum agent binary failed, %v", err)
+	}
+	info := &define.AgentInfo{
+		Host:    hostname,
+		Pid:     os.Getpid(),
+		Session: fmt.Sprintf("%x-%x", time.Now().UnixNano(), os.Getpid()),
+
+		Version:  define.Version,
+		Checksum: checksum,
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+	}
 
 	wg := &sync.WaitGroup{}
 	ctx, cancel := context.WithCancel(context.Background())
 
-	sendChannel := make(chan string, 2048)
-
-	wg.Add(1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		defer func() {
+		select {
+		case sig := <-signals:
+			l.Log(logger.LogLevelInfo, "receive signal %v", sig)
 			cancel()
-			wg.Done()
-		}()
-		for {
-			select {
-			case line := <-tail.Lines:
-				if line.Err != nil {
-					l.Log(logger.LogLevelError, "read log file failed, %v", line.Err)
-					continue
-				}
-				str := strings.TrimSpace(line.Text)
-				if len(str) == 0 {
-					continue
-				}
-
-				sendChannel <- str
-			case <-ctx.Done():
-				return
-			}
+		case <-ctx.Done():
 		}
 	}()
+	if params.ExitWithSession && stdin != nil {
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, stdin)
+			l.Log(logger.LogLevelInfo, "ssh session closed")
+			cancel()
+		}()
+	}
+
+	q := newQueue(defaultQueueSize)
+	coll := newCollector(l, cp.Time, resume, q)
+	coll.Update(ctx, params.Files)
 
 	wg.Add(1)
 	go func() {
@@ -94,49 +214,68 @@ func main() {
 			wg.Done()
 		}()
 
-		lines := make([]string, 0, 1024)
-		ticker := time.NewTicker(time.Second * 5)
-
-		send := func(limitLine int) error {
-			if len(lines) < limitLine {
-				return nil
-			}
+		newSender(params, info, l, sp, cp, tlsConfig, *enrollToken, &senderHooks{
+			OnConfig: func(files []*define.AgentFile) {
+				coll.Update(ctx, files)
+			},
+			OnBackfill: func(job *define.BackfillJob) {
+				coll.Backfill(ctx, job)
+			},
+			OnExit: cancel,
+			States: coll.States,
+		}).Run(ctx, q)
+	}()
 
-			pack, err := json.Marshal(lines)
-			if err != nil {
-				return fmt.Errorf("marshal pack failed, %v", err)
-			}
+	wg.Wait()
+	coll.Wait()
+	l.Log(logger.LogLevelInfo, "finish")
+}
 
-			if err := conn.SetWriteDeadline(time.Now().Add(time.Second * 10)); err != nil {
-				return fmt.Errorf("set write dead line failed, %v", err)
-			}
-			if err := conn.WriteMessage(websocket.BinaryMessage, pack); err != nil {
-				return fmt.Errorf("write message failed, %v", err)
-			}
+// binaryChecksum is the sha256 of the running agent binary, the manager compares it with
+// the binary it serves.
+func binaryChecksum() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("get executable failed, %w", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open executable failed, %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("read executable failed, %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-			lines = lines[:0]
-			return nil
+// pruneCheckpoint drops the positions of removed entries and of files that no longer
+// match their entry.
+func pruneCheckpoint(cp *checkpoint, files []*define.AgentFile) error {
+	entries := make(map[string]*define.AgentFile, len(files))
+	for _, file := range files {
+		entries[file.Key()] = file
+	}
+	for key, saved := range cp.Files {
+		file := entries[key]
+		if file == nil {
+			delete(cp.Files, key)
+			continue
 		}
-
-		for {
-			select {
-			case line := <-sendChannel:
-				lines = append(lines, line)
-				if err := send(1024); err != nil {
-					l.Log(logger.LogLevelError, "send pack failed, %v", err)
-					return
-				}
-			case <-ticker.C:
-				if err := send(0); err != nil {
-					l.Log(logger.LogLevelError, "send pack failed, %v", err)
-					return
-				}
-			case <-ctx.Done():
-				return
+		paths, err := tailer.Match(file.Path)
+		if err != nil {
+			return err
+		}
+		matched := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			matched[path] = true
+		}
+		for path := range saved {
+			if !matched[path] {
+				delete(saved, path)
 			}
 		}
-	}()
-
-	wg.Wait()
-	l.Log(logger.LogLevelInfo, "finish")
+	}
+	return nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+const (
+	defaultQueueSize  = 2048
+	defaultSampleRate = 10
+)
+
+// queue is the bounded buffer between the file pipelines and the sender, when it is
+// full the overflow policy of the file entry of the pushed record applies. drop-oldest
+// drops the oldest record in the queue whatever entry it belongs to.
+type queue struct {
+	C chan *record
+	// the backfill records and job statuses, they never overflow so no policy drops them
+	Jobs chan *record
+
+	mu       sync.Mutex
+	sampled  map[string]uint64
+	filtered map[string]uint64
+	overflow map[string]uint64
+	rotated  []*define.AgentRotation
+	// the job statuses of the batches that could not be kept
+	jobs []*define.AgentJobStatus
+	// lines dropped of each entry since the agent started
+	dropped map[string]uint64
+}
+
+func newQueue(size int) *queue {
+	return &queue{
+		C:        make(chan *record, size),
+		Jobs:     make(chan *record, size),
+		sampled:  make(map[string]uint64),
+		filtered: make(map[string]uint64),
+		overflow: make(map[string]uint64),
+		dropped:  make(map[string]uint64),
+	}
+}
+
+// Push returns false when ctx is done before a blocking push finishes.
+func (q *queue) Push(ctx context.Context, r *record) bool {
+	// backfill records are never dropped, the job just reads slower
+	if r.job != "" {
+		select {
+		case q.Jobs <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	overflow := r.file.Overflow
+	if overflow == nil {
+		overflow = &define.ConfigOverflow{Policy: define.OverflowBlock}
+	}
+
+	switch overflow.Policy {
+	case define.OverflowDropNewest:
+		q.pushOrDrop(r)
+	case define.OverflowDropOldest:
+		for {
+			select {
+			case q.C <- r:
+				return true
+			default:
+			}
+			select {
+			case old := <-q.C:
+				q.drop(old)
+			default:
+			}
+		}
+	case define.OverflowSample:
+		if len(q.C) >= cap(q.C)/2 && !q.sample(r.file.Key(), overflow.SampleRate) {
+			q.drop(r)
+			return true
+		}
+		q.pushOrDrop(r)
+	default:
+		select {
+		case q.C <- r:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (q *queue) pushOrDrop(r *record) {
+	select {
+	case q.C <- r:
+	default:
+		q.drop(r)
+	}
+}
+
+func (q *queue) sample(key string, rate int) bool {
+	if rate <= 0 {
+		rate = defaultSampleRate
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sampled[key]++
+	return q.sampled[key]%uint64(rate) == 0
+}
+
+// drop counts a record that never reaches the sender, a record the prefilter dropped
+// is only counted as such.
+func (q *queue) drop(r *record) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dropped[r.file.Key()]++
+	if r.dropped {
+		q.filtered[r.file.Key()]++
+	} else {
+		q.overflow[r.file.Key()]++
+	}
+}
+
+// Len is the count of records waiting for the sender.
+func (q *queue) Len() int {
+	return len(q.C) + len(q.Jobs)
+}
+
+// Dropped is the count of lines dropped of an entry since the agent started.
+func (q *queue) Dropped(key string) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped[key]
+}
+
+// Rotated keeps a rotation of a tailed file until the next batch.
+func (q *queue) Rotated(r *define.AgentRotation) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rotated = append(q.rotated, r)
+}
+
+// Lost counts the lines of a batch that could not be kept, they are reported with a later batch.
+func (q *queue) Lost(b *batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, r := range b.Records {
+		q.overflow[define.AgentFileKey(r.Target, r.Name)]++
+		q.dropped[define.AgentFileKey(r.Target, r.Name)]++
+	}
+	for key, count := range b.Dropped {
+		q.filtered[key] += count
+	}
+	for key, count := range b.Overflow {
+		q.overflow[key] += count
+	}
+	q.rotated = append(b.Rotations, q.rotated...)
+	q.jobs = append(b.Jobs, q.jobs...)
+}
+
+// Take moves the drop counters, rotations and job statuses into a batch.
+func (q *queue) Take(b *batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key, count := range q.filtered {
+		b.Dropped[key] += count
+	}
+	for key, count := range q.overflow {
+		b.Overflow[key] += count
+	}
+	b.Rotations = append(b.Rotations, q.rotated...)
+	b.Jobs = append(b.Jobs, q.jobs...)
+	q.filtered = make(map[string]uint64)
+	q.overflow = make(map[string]uint64)
+	q.rotated = nil
+	q.jobs = nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/tailer"
+)
+
+func TestQueueDropOldest(t *testing.T) {
+	file := &define.AgentFile{Target: "t", Name: "n", Overflow: &define.ConfigOverflow{Policy: define.OverflowDropOldest}}
+	q := newQueue(2)
+	ctx := context.Background()
+
+	q.Push(ctx, &record{file: file, line: &tailer.Line{Text: "backfill"}, job: "j"})
+	q.Push(ctx, &record{file: file, job: "j", status: &define.AgentJobStatus{ID: "j"}})
+	for _, text := range []string{"a", "b", "c", "d"} {
+		q.Push(ctx, &record{file: file, line: &tailer.Line{Text: text}})
+	}
+
+	// the tailed records make room for each other, the job records are kept
+	if q.Len() != 4 || q.Dropped(file.Key()) != 2 {
+		t.Fatalf("queued %d dropped %d, want 4 2", q.Len(), q.Dropped(file.Key()))
+	}
+	if r := <-q.Jobs; r.line.Text != "backfill" {
+		t.Errorf("job record %q", r.line.Text)
+	}
+	if r := <-q.Jobs; r.status == nil {
+		t.Error("job status evicted")
+	}
+	if r := <-q.C; r.line.Text != "c" {
+		t.Errorf("oldest record %q, want c", r.line.Text)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	defaultBatchLines = 1024
+	defaultFlushTime  = time.Second * 5
+	// heartbeats tell the manager the agent is alive when there is nothing to send
+	defaultHeartbeatInterval = time.Second * 3
+	defaultDialTimeout       = time.Second * 5
+	defaultWriteTimeout      = time.Second * 10
+	defaultMinBackoff        = time.Second
+	defaultMaxBackoff        = time.Second * 30
+	// batches in flight without acknowledgement, the rest waits in the spool
+	defaultMaxPending = 64
+)
+
+// batch is a group of records shipped in one message, Files is the position after the
+// last record of each file in it.
+type batch struct {
+	Session   string                   `json:"session"`
+	Seq       uint64                   `json:"seq"`
+	Records   []*define.AgentRecord    `json:"records"`
+	Dropped   map[string]uint64        `json:"dropped"`
+	Overflow  map[string]uint64        `json:"overflow"`
+	Files     positions                `json:"files"`
+	Jobs      []*define.AgentJobStatus `json:"jobs"`
+	Rotations []*define.AgentRotation  `json:"rotations"`
+}
+
+func (b *batch) Empty() bool {
+	return len(b.Records) == 0 && len(b.Dropped) == 0 && len(b.Overflow) == 0 && len(b.Jobs) == 0 && len(b.Rotations) == 0
+}
+
+// sender ships batches of lines to the manager, reconnecting with backoff when the
+// websocket drops and spooling the batches to disk while it is disconnected.
+// The checkpoint only advances when the manager acknowledges a batch.
+type sender struct {
+	params     *define.AgentParams
+	info       *define.AgentInfo
+	logger     logger.Log
+	spool      *spool
+	checkpoint *checkpoint
+	queue      *queue
+	hooks      *senderHooks
+	dialer     *websocket.Dialer
+	// the enroll token of an enrolled agent, sent on every connect
+	enrollToken string
+	seq         uint64
+	recordSeq   uint64
+	// compression of the batches, it follows the config pushed by manager
+	compression string
+
+	conn      *websocket.Conn
+	connDone  chan struct{}
+	connClose chan struct{}
+	messages  chan *define.ManagerMessage
+	backoff   time.Duration
+	nextDial  time.Time
+
+	current *batch
+	pending []*batch
+}
+
+// senderHooks hand the manager messages over to the rest of the agent.
+type senderHooks struct {
+	OnConfig   func(files []*define.AgentFile)
+	OnBackfill func(job *define.BackfillJob)
+	// OnExit stops the agent when the manager asks it to upgrade or shut down
+	OnExit func()
+	// States reports the file entries in the heartbeats
+	States func() []*define.AgentFileState
+}
+
+func newSender(params *define.AgentParams, info *define.AgentInfo, l logger.Log, s *spool, cp *checkpoint, tlsConfig *tls.Config, enrollToken string, hooks *senderHooks) *sender {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	sd := &sender{
+		params:     params,
+		info:       info,
+		logger:     l,
+		spool:      s,
+		checkpoint: cp,
+		hooks:      hooks,
+		dialer:     &dialer,
+
+		enrollToken: enrollToken,
+
+		compression: params.Compression,
+		recordSeq:   cp.Seq,
+	}
+	sd.next()
+	return sd
+}
+
+func (s *sender) Run(ctx context.Context, q *queue) {
+	s.queue = q
+	lines, jobs := q.C, q.Jobs
+	ticker := time.NewTicker(defaultFlushTime)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(defaultHeartbeatInterval)
+	defer heartbeat.Stop()
+	defer s.disconnect(nil)
+
+	s.connect(ctx)
+	for {
+		select {
+		case r := <-lines:
+			s.add(r)
+			if len(s.current.Records) >= defaultBatchLines {
+				s.flush(ctx)
+			}
+		case r := <-jobs:
+			s.add(r)
+			if len(s.current.Records) >= defaultBatchLines {
+				s.flush(ctx)
+			}
+		case <-ticker.C:
+			s.flush(ctx)
+		case <-heartbeat.C:
+			s.heartbeat()
+		case msg := <-s.messages:
+			switch msg.Type {
+			case define.ManagerMessageAck:
+				s.ack(msg)
+			case define.ManagerMessageConfig:
+				s.logger.Log(logger.LogLevelInfo, "receive config files %d compression %s", len(msg.Files), msg.Compression)
+				s.compression = msg.Compression
+				s.hooks.OnConfig(msg.Files)
+			case define.ManagerMessageBackfill:
+				if msg.Job != nil && msg.Job.File != nil {
+					s.hooks.OnBackfill(msg.Job)
+				}
+			case define.ManagerMessageUpgrade:
+				s.logger.Log(logger.LogLevelInfo, "manager asks to upgrade, exit. %s", msg.Reason)
+				s.hooks.OnExit()
+			case define.ManagerMessageShutdown:
+				s.logger.Log(logger.LogLevelInfo, "manager asks to shut down, exit. %s", msg.Reason)
+				s.hooks.OnExit()
+			case define.ManagerMessageToken:
+				if msg.Token != "" {
+					s.params.Token = msg.Token
+				}
+			}
+		case <-s.connDone:
+			s.disconnect(fmt.Errorf("connection closed by manager"))
+		case <-ctx.Done():
+			s.drain(lines)
+			s.queue.Take(s.current)
+			if !s.current.Empty() {
+				s.seal()
+				if err := s.spool.Append(s.current); err != nil {
+					s.logger.Log(logger.LogLevelError, "spool lines on exit failed, %v", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+func (s *sender) add(r *record) {
+	if r.status != nil {
+		s.current.Jobs = append(s.current.Jobs, r.status)
+		return
+	}
+	if r.job == "" {
+		s.current.Files.Set(r.file.Key(), r.line.Path, r.line.Pos)
+	}
+	if r.dropped {
+		s.current.Dropped[r.file.Key()]++
+		return
+	}
+	s.recordSeq++
+	s.current.Records = append(s.current.Records, &define.AgentRecord{
+		Target: r.file.Target,
+		Name:   r.file.Name,
+		Path:   r.line.Path,
+		Text:   r.line.Text,
+		Offset: r.line.Offset,
+		Inode:  r.line.Pos.Inode,
+		Time:   r.line.Time.UnixNano(),
+		Seq:    s.recordSeq,
+		Job:    r.job,
+	})
+}
+
+func (s *sender) drain(lines <-chan *record) {
+	for {
+		select {
+		case r := <-lines:
+			s.add(r)
+		default:
+			return
+		}
+	}
+}
+
+// seal gives the current batch its sequence before it leaves the sender.
+func (s *sender) seal() {
+	s.seq++
+	s.current.Session = s.info.Session
+	s.current.Seq = s.seq
+}
+
+func (s *sender) next() {
+	s.current = &batch{
+		Records:  make([]*define.AgentRecord, 0, defaultBatchLines),
+		Dropped:  make(map[string]uint64),
+		Overflow: make(map[string]uint64),
+		Files:    make(positions),
+	}
+}
+
+func (s *sender) flush(ctx context.Context) {
+	if s.conn == nil {
+		s.connect(ctx)
+	}
+	if s.conn != nil {
+		if err := s.replay(); err != nil {
+			s.disconnect(err)
+		}
+	}
+
+	s.queue.Take(s.current)
+	if s.current.Empty() {
+		return
+	}
+
+	s.seal()
+	// the spooled batches go first to keep the sequence in order
+	if s.conn != nil && s.spool.Empty() && len(s.pending) < defaultMaxPending {
+		if err := s.write(s.current); err != nil {
+			s.disconnect(err)
+		} else {
+			s.next()
+			return
+		}
+	}
+
+	if err := s.spool.Append(s.current); err != nil {
+		s.queue.Lost(s.current)
+		s.logger.Log(logger.LogLevelError, "spool lines failed, %v", err)
+	}
+	s.next()
+}
+
+// heartbeat reports the read positions, the line counts and the memory use of the
+// agent, it also notices a closed connection when there is nothing to send.
+func (s *sender) heartbeat() {
+	if s.conn == nil {
+		return
+	}
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	err := s.send(&define.AgentMessage{Type: define.AgentMessageHeartbeat, Heartbeat: &define.AgentHeartbeat{
+		Version:    define.Version,
+		HeapBytes:  mem.HeapAlloc,
+		SysBytes:   mem.Sys,
+		Goroutines: runtime.NumGoroutine(),
+		Queued:     s.queue.Len(),
+		Files:      s.hooks.States(),
+	}})
+	if err != nil {
+		s.disconnect(err)
+	}
+}
+
+// ack handles the acknowledgement of a batch in flight, the batches are processed
+// in order so every batch before it is done as well.
+func (s *sender) ack(msg *define.ManagerMessage) {
+	index := -1
+	for i, b := range s.pending {
+		if b.Session == msg.Session && b.Seq == msg.Seq {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		s.logger.Log(logger.LogLevelWarning, "ack batch not found, session:%s seq:%d", msg.Session, msg.Seq)
+		return
+	}
+
+	acked := make(positions)
+	var seq uint64
+	for _, b := range s.pending[:index+1] {
+		acked.Merge(b.Files)
+		if n := len(b.Records); n > 0 {
+			seq = b.Records[n-1].Seq
+		}
+	}
+	s.pending = s.pending[index+1:]
+	if err := s.checkpoint.Save(acked, seq); err != nil {
+		s.logger.Log(logger.LogLevelError, "save checkpoint failed, %v", err)
+	}
+}
+
+func (s *sender) connect(ctx context.Context) {
+	if time.Now().Before(s.nextDial) {
+		return
+	}
+
+	connCtx, connCancel := context.WithTimeout(ctx, defaultDialTimeout)
+	defer connCancel()
+	// the token the manager signed for this launch
+	header := http.Header{"Authorization": []string{"Bearer " + s.params.Token}}
+	if s.enrollToken != "" {
+		header.Set(define.EnrollTokenHeader, s.enrollToken)
+	}
+	conn, resp, err := s.dialer.DialContext(connCtx, s.params.WebSocketAddr, header)
+	if err != nil {
+		// the manager turns away an agent of a replaced launch or with a bad token
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			reason, _ := ioutil.ReadAll(resp.Body)
+			s.logger.Log(logger.LogLevelInfo, "manager rejects the agent, exit. %s", strings.TrimSpace(string(reason)))
+			s.hooks.OnExit()
+		}
+		if s.backoff == 0 {
+			s.backoff = defaultMinBackoff
+		} else if s.backoff *= 2; s.backoff > defaultMaxBackoff {
+			s.backoff = defaultMaxBackoff
+		}
+		s.nextDial = time.Now().Add(s.backoff)
+		s.logger.Log(logger.LogLevelError, "websocket connect error, retry after %v, %v", s.backoff, err)
+		return
+	}
+
+	s.logger.Log(logger.LogLevelInfo, "websocket connected %s", s.params.WebSocketAddr)
+	s.conn = conn
+	s.connDone = make(chan struct{})
+	s.connClose = make(chan struct{})
+	s.messages = make(chan *define.ManagerMessage, 1024)
+	s.backoff = 0
+	go s.reader(conn, s.connDone, s.connClose, s.messages)
+
+	if err := s.send(&define.AgentMessage{Type: define.AgentMessageHello, Agent: s.info}); err != nil {
+		s.disconnect(err)
+	}
+}
+
+func (s *sender) disconnect(err error) {
+	if s.conn == nil {
+		return
+	}
+	if err != nil {
+		s.logger.Log(logger.LogLevelError, "websocket disconnect, %v", err)
+	}
+	_ = s.conn.Close()
+	close(s.connClose)
+	s.conn = nil
+	s.connDone = nil
+	s.connClose = nil
+	s.messages = nil
+	s.nextDial = time.Now().Add(defaultMinBackoff)
+
+	// batches without acknowledgement are sent again after reconnect, the manager
+	// skips the ones it has already processed by their sequence
+	if len(s.pending) > 0 {
+		batches, loadErr := s.spool.Load()
+		if loadErr != nil {
+			s.logger.Log(logger.LogLevelError, "load spool failed, %v", loadErr)
+		}
+		if resetErr := s.resetSpool(append(s.pending, batches...)); resetErr != nil {
+			s.logger.Log(logger.LogLevelError, "spool pending batches failed, %v", resetErr)
+		}
+		s.pending = nil
+	}
+}
+
+// reader receives the acknowledgements and configs from manager, it also notices a
+// closed connection when there is nothing to send.
+func (s *sender) reader(conn *websocket.Conn, done chan struct{}, closed chan struct{}, messages chan *define.ManagerMessage) {
+	defer close(done)
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := &define.ManagerMessage{}
+		if err := json.Unmarshal(message, msg); err != nil {
+			s.logger.Log(logger.LogLevelError, "manager message unmarshal failed, %v", err)
+			continue
+		}
+		switch msg.Type {
+		case define.ManagerMessageAck, define.ManagerMessageConfig, define.ManagerMessageBackfill, define.ManagerMessageUpgrade, define.ManagerMessageShutdown, define.ManagerMessageToken:
+		default:
+			continue
+		}
+		select {
+		case messages <- msg:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (s *sender) replay() error {
+	if s.spool.Empty() || len(s.pending) >= defaultMaxPending {
+		return nil
+	}
+
+	batches, err := s.spool.Load()
+	if err != nil {
+		return err
+	}
+	s.logger.Log(logger.LogLevelInfo, "replay spool batches %d pending %d", len(batches), len(s.pending))
+	for i, b := range batches {
+		if len(s.pending) >= defaultMaxPending {
+			return s.resetSpool(batches[i:])
+		}
+		if err := s.write(b); err != nil {
+			if resetErr := s.resetSpool(batches[i:]); resetErr != nil {
+				s.logger.Log(logger.LogLevelError, "reset spool failed, %v", resetErr)
+			}
+			return err
+		}
+	}
+	return s.resetSpool(nil)
+}
+
+// resetSpool rewrites the spool, the lines of the batches that no longer fit are counted
+// as dropped.
+func (s *sender) resetSpool(batches []*batch) error {
+	evicted, err := s.spool.Reset(batches)
+	for _, b := range evicted {
+		s.queue.Lost(b)
+	}
+	if len(evicted) > 0 {
+		s.logger.Log(logger.LogLevelError, "spool full, evicted batches:%d dropped:%d", len(evicted), s.spool.dropped)
+	}
+	return err
+}
+
+func (s *sender) write(b *batch) error {
+	err := s.send(&define.AgentMessage{
+		Type:     define.AgentMessageBatch,
+		Session:  b.Session,
+		Seq:      b.Seq,
+		Records:  b.Records,
+		Dropped:  b.Dropped,
+		Overflow: b.Overflow,
+		Jobs:     b.Jobs,
+
+		Rotations: b.Rotations,
+	})
+	if err != nil {
+		return err
+	}
+	s.pending = append(s.pending, b)
+	return nil
+}
+
+func (s *sender) send(msg *define.AgentMessage) error {
+	msg.Version = define.AgentProtocolVersion
+	pack, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal pack failed, %v", err)
+	}
+	if msg.Type == define.AgentMessageBatch {
+		if pack, err = define.Compress(s.compression, pack); err != nil {
+			return fmt.Errorf("compress pack failed, %v", err)
+		}
+	}
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(defaultWriteTimeout)); err != nil {
+		return fmt.Errorf("set write dead line failed, %v", err)
+	}
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, pack); err != nil {
+		return fmt.Errorf("write message failed, %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	defaultSpoolMaxSize = 64 * 1024 * 1024
+)
+
+// spool keeps the batches that could not be delivered while the manager is unreachable,
+// one json encoded batch per line, so that they can be replayed in order after reconnect.
+type spool struct {
+	path    string
+	maxSize int64
+	size    int64
+	dropped int
+}
+
+func newSpool(path string, maxSize int64) (*spool, error) {
+	if maxSize <= 0 {
+		maxSize = defaultSpoolMaxSize
+	}
+	s := &spool{path: path, maxSize: maxSize}
+
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("stat spool file failed, %w", err)
+	}
+	if info != nil {
+		s.size = info.Size()
+	}
+	return s, nil
+}
+
+func (s *spool) Empty() bool {
+	return s.size == 0
+}
+
+func (s *spool) Append(b *batch) error {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("marshal spool batch failed, %w", err)
+	}
+	buf = append(buf, '\n')
+
+	if s.size+int64(len(buf)) > s.maxSize {
+		s.dropped += len(b.Records)
+		return fmt.Errorf("spool full, size:%d max:%d dropped:%d", s.size, s.maxSize, s.dropped)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open spool file failed, %w", err)
+	}
+	defer f.Close()
+
+	n, err := f.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write spool file failed, %w", err)
+	}
+	return nil
+}
+
+func (s *spool) Load() ([]*batch, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open spool file failed, %w", err)
+	}
+	defer f.Close()
+
+	var batches []*batch
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), int(s.maxSize)+1)
+	for scanner.Scan() {
+		b := &batch{}
+		if err := json.Unmarshal(scanner.Bytes(), b); err != nil {
+			// a partial write from a crashed agent, skip it
+			continue
+		}
+		batches = append(batches, b)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read spool file failed, %w", err)
+	}
+	return batches, nil
+}
+
+// Reset replaces the spool content with the batches that are still not delivered. The
+// batches beyond the max size are evicted and returned, the newest go first like the
+// ones Append refuses.
+func (s *spool) Reset(batches []*batch) ([]*batch, error) {
+	var data []byte
+	var evicted []*batch
+	for i, b := range batches {
+		buf, err := json.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("marshal spool batch failed, %w", err)
+		}
+		if int64(len(data)+len(buf)+1) > s.maxSize {
+			evicted = batches[i:]
+			for _, b := range evicted {
+				s.dropped += len(b.Records)
+			}
+			break
+		}
+		data = append(data, buf...)
+		data = append(data, '\n')
+	}
+
+	if len(data) == 0 {
+		err := os.Remove(s.path)
+		if err != nil && !os.IsNotExist(err) {
+			return evicted, fmt.Errorf("remove spool file failed, %w", err)
+		}
+		s.size = 0
+		return evicted, nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return evicted, fmt.Errorf("write spool file failed, %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return evicted, fmt.Errorf("rename spool file failed, %w", err)
+	}
+	s.size = int64(len(data))
+	return evicted, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+func testBatch(seq uint64, texts ...string) *batch {
+	b := &batch{Session: "s", Seq: seq}
+	for _, text := range texts {
+		b.Records = append(b.Records, &define.AgentRecord{Target: "t", Name: "n", Text: text})
+	}
+	return b
+}
+
+func batchSeqs(batches []*batch) []uint64 {
+	var seqs []uint64
+	for _, b := range batches {
+		seqs = append(seqs, b.Seq)
+	}
+	return seqs
+}
+
+func TestSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	s, err := newSpool(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Empty() {
+		t.Fatal("new spool not empty")
+	}
+	batches, err := s.Load()
+	if err != nil || len(batches) != 0 {
+		t.Fatalf("load empty spool %v %v", batches, err)
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := s.Append(testBatch(seq, "a", "b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batches, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqs := batchSeqs(batches); !reflect.DeepEqual(seqs, []uint64{1, 2, 3}) {
+		t.Fatalf("spooled %v, want 1 2 3", seqs)
+	}
+	if batches[0].Records[1].Text != "b" {
+		t.Errorf("spooled record %+v", batches[0].Records[1])
+	}
+
+	// the spool of an earlier run is picked up with its size
+	reopened, err := newSpool(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Empty() || reopened.size != s.size {
+		t.Errorf("reopened size %d, want %d", reopened.size, s.size)
+	}
+
+	if _, err := s.Reset(batches[2:]); err != nil {
+		t.Fatal(err)
+	}
+	batches, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqs := batchSeqs(batches); !reflect.DeepEqual(seqs, []uint64{3}) {
+		t.Fatalf("spooled after reset %v, want 3", seqs)
+	}
+
+	if _, err := s.Reset(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Empty() {
+		t.Error("spool not empty after reset")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spool file left after reset, %v", err)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	buf, err := json.Marshal(testBatch(1, "abcdefghij"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for three and a half batches
+	s, err := newSpool(filepath.Join(t.TempDir(), "spool"), int64(len(buf)+1)*7/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var appended int
+	for seq := uint64(1); seq <= 9; seq++ {
+		if err := s.Append(testBatch(seq, "abcdefghij")); err == nil {
+			appended++
+		}
+	}
+	if appended != 3 {
+		t.Fatalf("appended %d batches, want 3", appended)
+	}
+	if s.size > s.maxSize {
+		t.Errorf("spool size %d beyond %d", s.size, s.maxSize)
+	}
+	if s.dropped != 6 {
+		t.Errorf("dropped %d records, want 6", s.dropped)
+	}
+	batches, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != appended {
+		t.Errorf("loaded %d batches, want %d", len(batches), appended)
+	}
+}
+
+func TestSpoolResetFull(t *testing.T) {
+	buf, err := json.Marshal(testBatch(1, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for two and a half batches
+	s, err := newSpool(filepath.Join(t.TempDir(), "spool"), int64(len(buf)+1)*5/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := []*batch{testBatch(1, "a", "b"), testBatch(2, "a", "b"), testBatch(3, "a", "b"), testBatch(4, "a", "b")}
+	evicted, err := s.Reset(batches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqs := batchSeqs(evicted); !reflect.DeepEqual(seqs, []uint64{3, 4}) {
+		t.Errorf("evicted %v, want 3 4", seqs)
+	}
+	if s.size > s.maxSize || s.dropped != 4 {
+		t.Errorf("spool size %d max %d dropped %d", s.size, s.maxSize, s.dropped)
+	}
+	kept, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqs := batchSeqs(kept); !reflect.DeepEqual(seqs, []uint64{1, 2}) {
+		t.Errorf("kept %v, want 1 2", seqs)
+	}
+}
+
+func TestSpoolPartialWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	s, err := newSpool(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(testBatch(1, "a")); err != nil {
+		t.Fatal(err)
+	}
+	// a crashed agent left half a batch behind
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"session":"s","seq":2,"reco` + "\n")
+	_ = f.Close()
+	if err := s.Append(testBatch(3, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	batches, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqs := batchSeqs(batches); !reflect.DeepEqual(seqs, []uint64{1, 3}) {
+		t.Errorf("loaded %v, want 1 3", seqs)
+	}
+}
@@ -0,0 +1,914 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lsg2020/goco"
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	maxAgentSessions = 16
+	// latest rotations kept for the status api
+	maxAgentRotations = 32
+
+	// a connected agent without heartbeat for this long is stalled
+	agentHeartbeatTimeout = time.Second * 10
+	// a file entry that has bytes left to read but reads nothing for this long is stalled,
+	// one that reads nothing with nothing left is idle
+	fileStallTime = time.Second * 30
+	fileIdleTime  = time.Minute
+	agentStateDir = ".logfilter"
+	// an agent running another binary is asked to upgrade at most this often, a host that
+	// keeps coming back with it runs on instead of restarting in a loop
+	agentUpgradeInterval = time.Minute * 10
+)
+
+// agent is the remote agent of one ssh login, it tails the log files of every target
+// on that host and hands the records over to the clients of their targets.
+type agent struct {
+	Key    string
+	config *define.Config
+	logger logger.Log
+	co     *co.Coroutine
+	ctx    context.Context
+	cancel context.CancelFunc
+	mgr    *manager
+
+	ssh         *define.ConfigLogFileInfo
+	files       []*define.AgentFile
+	compression string
+	clients     map[string]*client
+
+	conn       *websocket.Conn
+	connCancel context.CancelFunc
+	connTime   time.Time
+	writeMu    sync.Mutex
+	state      *agentState
+
+	jobs     map[string]*backfillJob
+	jobOrder []string
+
+	upgrades    uint64
+	upgradeTime time.Time
+	// the platform and host key seen over ssh and why the last deployment failed
+	platform    string
+	hostKey     string
+	deployError string
+	// the remote end of the reverse tunnel the agent connects through
+	tunnel string
+	// the collector of the files on the manager host, nil for the remote agents
+	local *localCollector
+}
+
+// agentState tracks the batch sequences received from an agent, batches of the same
+// agent session arrive in order so a smaller sequence is a duplicate and a jump is a gap.
+type agentState struct {
+	Agent      *define.AgentInfo
+	Gaps       uint64
+	Duplicates uint64
+	Batches    uint64
+	WireBytes  uint64
+	RawBytes   uint64
+	// records received and lines dropped by the agent prefilters of each file entry
+	Records map[string]uint64
+	Dropped map[string]uint64
+	// lines lost on the agent by the overflow policy or a full spool
+	Overflow map[string]uint64
+	// rotations of the tailed files of each file entry and the latest ones
+	Rotations       map[string]uint64
+	RecentRotations []*define.AgentRotation
+	Heartbeat       *define.AgentHeartbeat
+	LastHeartbeat   time.Time
+	// the last time the read count of each file entry went up
+	progress map[string]*fileProgress
+
+	sessions     map[string]uint64
+	sessionOrder []string
+	// the batch that was handed over to some of its targets only
+	partial *partialBatch
+}
+
+type partialBatch struct {
+	session   string
+	seq       uint64
+	delivered map[string]bool
+}
+
+func (as *agentState) Accept(session string, seq uint64, l logger.Log, key string) bool {
+	last, ok := as.sessions[session]
+	if ok && seq <= last {
+		as.Duplicates++
+		l.Log(logger.LogLevelWarning, "agent receiver duplicate batch %v session:%s seq:%d last:%d", key, session, seq, last)
+		return false
+	}
+	if ok && seq > last+1 {
+		as.Gaps++
+		l.Log(logger.LogLevelWarning, "agent receiver batch gap %v session:%s seq:%d last:%d", key, session, seq, last)
+	}
+
+	if !ok {
+		as.sessionOrder = append(as.sessionOrder, session)
+		if len(as.sessionOrder) > maxAgentSessions {
+			delete(as.sessions, as.sessionOrder[0])
+			as.sessionOrder = as.sessionOrder[1:]
+		}
+	}
+	as.sessions[session] = seq
+	return true
+}
+
+// Unaccept forgets a batch that was accepted but not handed over to every target, the
+// next one of its session is the same batch again. delivered are the targets that got it.
+func (as *agentState) Unaccept(session string, seq uint64, delivered map[string]bool) {
+	if last, ok := as.sessions[session]; ok && last == seq {
+		as.sessions[session] = seq - 1
+		as.partial = &partialBatch{session: session, seq: seq, delivered: delivered}
+	}
+}
+
+// Delivered returns the targets that got a batch before it was unaccepted, nil when it
+// is seen for the first time.
+func (as *agentState) Delivered(session string, seq uint64) map[string]bool {
+	p := as.partial
+	as.partial = nil
+	if p == nil || p.session != session || p.seq != seq {
+		return nil
+	}
+	return p.delivered
+}
+
+type fileProgress struct {
+	read uint64
+	last time.Time
+}
+
+func (as *agentState) OnHeartbeat(hb *define.AgentHeartbeat, now time.Time) {
+	as.Heartbeat = hb
+	as.LastHeartbeat = now
+	for _, f := range hb.Files {
+		key := define.AgentFileKey(f.Target, f.Name)
+		if p := as.progress[key]; p == nil || p.read != f.Read {
+			as.progress[key] = &fileProgress{read: f.Read, last: now}
+		}
+	}
+}
+
+func (as *agentState) Rotated(r *define.AgentRotation) {
+	as.Rotations[define.AgentFileKey(r.Target, r.Name)]++
+	as.RecentRotations = append(as.RecentRotations, r)
+	if n := len(as.RecentRotations); n > maxAgentRotations {
+		as.RecentRotations = as.RecentRotations[n-maxAgentRotations:]
+	}
+}
+
+func (a *agent) Start(r func(error)) {
+	a.logger.Log(logger.LogLevelDebug, "agent start key:%s", a.Key)
+
+	// the local files are tailed in-process, there is no agent to deploy
+	start := a.monitor
+	if a.isLocal() {
+		start = a.startLocal
+	}
+	err := a.co.RunAsync(a.ctx, start, &co.RunOptions{})
+	r(err)
+}
+
+func (a *agent) Reload(config *define.Config, sshCfg *define.ConfigLogFileInfo, files []*define.AgentFile, compression string, clients map[string]*client, r func(error)) {
+	err := a.co.RunAsync(a.ctx, func(ctx context.Context) error {
+		changed := !reflect.DeepEqual(a.files, files) || a.compression != compression
+		a.config = config
+		a.ssh = sshCfg
+		a.files = files
+		a.compression = compression
+		a.clients = clients
+		if changed && a.local != nil {
+			a.local.Update(a.ctx, files)
+		}
+		if changed && a.conn != nil {
+			return a.sendConfig(a.conn)
+		}
+		return nil
+	}, &co.RunOptions{Result: r})
+	if err != nil {
+		r(err)
+	}
+}
+
+// Shutdown stops the remote agent of a host without open targets and closes the agent. The
+// remote agent is asked to exit and its tracked pid is killed over ssh when it does not.
+// The remote binary and state are removed only with cleanup, when the host is removed from
+// config, a host whose targets are closed keeps its checkpoint and unacked spool.
+func (a *agent) Shutdown(cleanup bool) {
+	err := a.co.RunAsync(a.ctx, func(ctx context.Context) error {
+		return a.shutdown(ctx, cleanup)
+	}, &co.RunOptions{Result: func(err error) {
+		if err != nil {
+			a.logger.Log(logger.LogLevelError, "agent shutdown failed, key:%s %v", a.Key, err)
+		}
+		a.Close()
+	}})
+	if err != nil {
+		a.logger.Log(logger.LogLevelError, "agent shutdown failed, key:%s %v", a.Key, err)
+		a.Close()
+	}
+}
+
+func (a *agent) shutdown(ctx context.Context, cleanup bool) error {
+	a.logger.Log(logger.LogLevelInfo, "agent shutdown key:%s cleanup:%v", a.Key, cleanup)
+	// the monitor deploys no agent without files
+	a.files = nil
+	if a.isLocal() {
+		// the local files stop with the agent context
+		return nil
+	}
+
+	var pid int
+	if a.state.Agent != nil {
+		pid = a.state.Agent.Pid
+	}
+	if a.conn != nil {
+		reason := "targets of host closed"
+		if cleanup {
+			reason = "host removed from config"
+		}
+		err := a.writeMessage(a.conn, &define.ManagerMessage{Type: define.ManagerMessageShutdown, Reason: reason})
+		if err != nil {
+			a.logger.Log(logger.LogLevelWarning, "agent send shutdown failed, key:%s %v", a.Key, err)
+		}
+	}
+	if a.enrolled() {
+		// the binary and state of an enrolled agent belong to whoever installed it
+		return nil
+	}
+
+	config, sshCfg := a.config, a.ssh
+	script := stopAgentScript(pid, sshCfg.AgentDir, cleanup)
+	if script == "" {
+		return nil
+	}
+	return a.co.Await(ctx, func(ctx context.Context) error {
+		conn, _, err := dialSSH(config, sshCfg, a.logger)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return conn.Run(script, a, a)
+	})
+}
+
+// stopAgentScript waits for the agent process to exit and kills it when it does not, with
+// cleanup it removes the agent binary and state then.
+func stopAgentScript(pid int, dir string, cleanup bool) string {
+	var script []string
+	if pid > 0 {
+		script = append(script, fmt.Sprintf(`if ps -p %[1]d -o args= 2>/dev/null | grep -q %[2]s; then `+
+			`for i in 1 2 3 4 5 6 7 8 9 10; do kill -0 %[1]d 2>/dev/null || break; sleep 0.5; done; `+
+			`kill %[1]d 2>/dev/null && sleep 1; kill -0 %[1]d 2>/dev/null && kill -9 %[1]d; fi`, pid, remoteAgentFile))
+	}
+	if cleanup {
+		remote := remoteAgentPath(dir)
+		script = append(script, fmt.Sprintf("rm -rf %s %s %s", shellQuote(remote), shellQuote(remote+".upload"), shellQuote(agentStateDir)))
+	}
+	return strings.Join(script, "; ")
+}
+
+func (a *agent) Close() {
+	a.logger.Log(logger.LogLevelDebug, "agent close key:%s", a.Key)
+
+	a.co.Close()
+	a.cancel()
+}
+
+func (a *agent) BindAgentWS(conn *websocket.Conn, token string, r func(error)) {
+	err := a.co.RunAsync(a.ctx, func(ctx context.Context) error {
+		if a.connCancel != nil {
+			a.connCancel()
+		}
+
+		ctx, cancel := context.WithCancel(a.ctx)
+		a.connCancel = cancel
+		a.conn = conn
+		a.connTime = time.Now()
+		go a.receiver(ctx, conn, token)
+		return nil
+	}, &co.RunOptions{Result: r})
+	if err != nil {
+		r(err)
+	}
+}
+
+func (a *agent) receiver(ctx context.Context, conn *websocket.Conn, token string) {
+	defer func() {
+		a.logger.Log(logger.LogLevelDebug, "agent finish receiver %v %v", a.Key, conn.RemoteAddr().String())
+		_ = conn.Close()
+		_ = a.co.RunAsync(ctx, func(ctx context.Context) error {
+			if a.conn == conn {
+				a.conn = nil
+				a.connCancel()
+				a.connCancel = nil
+			}
+			return nil
+		}, nil)
+	}()
+
+	a.logger.Log(logger.LogLevelDebug, "agent start receiver %v %v", a.Key, conn.RemoteAddr().String())
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second * 10)); err != nil {
+			a.logger.Log(logger.LogLevelDebug, "agent receiver set read dead line failed %v %v %v", a.Key, conn.RemoteAddr().String(), err)
+			return
+		}
+
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			a.logger.Log(logger.LogLevelDebug, "agent receiver read message failed %v %v %v", a.Key, conn.RemoteAddr().String(), err)
+			return
+		}
+		message, err := define.Decompress(frame)
+		if err != nil {
+			a.logger.Log(logger.LogLevelDebug, "agent receiver decompress message failed %v %v %v", a.Key, conn.RemoteAddr().String(), err)
+			return
+		}
+
+		msg := &define.AgentMessage{}
+		err = json.Unmarshal(message, msg)
+		if err != nil {
+			a.logger.Log(logger.LogLevelDebug, "agent receiver read message unmarshal failed %v %v %v", a.Key, conn.RemoteAddr().String(), err)
+			return
+		}
+		if msg.Version != define.AgentProtocolVersion {
+			a.logger.Log(logger.LogLevelError, "agent receiver protocol version mismatch %v %v agent:%d manager:%d", a.Key, conn.RemoteAddr().String(), msg.Version, define.AgentProtocolVersion)
+			// the agent exits and is started again with the binary of the manager
+			_ = a.writeMessage(conn, &define.ManagerMessage{Type: define.ManagerMessageUpgrade, Reason: fmt.Sprintf("protocol version %d, manager speaks %d", msg.Version, define.AgentProtocolVersion)})
+			return
+		}
+
+		switch msg.Type {
+		case define.AgentMessageHello:
+			a.logger.Log(logger.LogLevelInfo, "agent receiver hello %v %v %#v", a.Key, conn.RemoteAddr().String(), msg.Agent)
+			err = a.co.RunSync(ctx, func(ctx context.Context) error {
+				a.state.Agent = msg.Agent
+				if msg.Agent != nil {
+					a.failJobs(msg.Agent.Session)
+					if reason := a.checkBinary(msg.Agent); reason != "" {
+						a.upgrades++
+						a.upgradeTime = time.Now()
+						a.logger.Log(logger.LogLevelInfo, "agent receiver upgrade agent %v %v %s", a.Key, conn.RemoteAddr().String(), reason)
+						return a.writeMessage(conn, &define.ManagerMessage{Type: define.ManagerMessageUpgrade, Reason: reason})
+					}
+				}
+				// the agent may run with the files of an older config
+				return a.sendConfig(conn)
+			}, nil)
+		case define.AgentMessageHeartbeat:
+			if msg.Heartbeat == nil {
+				break
+			}
+			err = a.co.RunSync(ctx, func(ctx context.Context) error {
+				a.state.OnHeartbeat(msg.Heartbeat, time.Now())
+				// the agent reconnects with a token signed before it expires
+				if refreshed := a.mgr.tokens.Refresh(a.Key, token); refreshed != "" {
+					token = refreshed
+					return a.writeMessage(conn, &define.ManagerMessage{Type: define.ManagerMessageToken, Token: token})
+				}
+				return nil
+			}, nil)
+		case define.AgentMessageBatch:
+			err = a.handleBatch(ctx, msg, len(frame), len(message))
+			if err == nil {
+				// the agent moves its checkpoint forward once the batch is queued for the filters
+				err = a.writeMessage(conn, &define.ManagerMessage{Type: define.ManagerMessageAck, Session: msg.Session, Seq: msg.Seq})
+			}
+		}
+		if err != nil {
+			a.logger.Log(logger.LogLevelDebug, "agent receiver handle message failed %v %v %s %v", a.Key, conn.RemoteAddr().String(), msg.Type, err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			a.logger.Log(logger.LogLevelDebug, "agent receiver ctx done %v %v %v", a.Key, conn.RemoteAddr().String(), ctx.Err())
+			return
+		default:
+		}
+	}
+}
+
+// handleBatch hands the records of a batch to the clients of their targets, the records
+// of a target that is gone are dropped.
+func (a *agent) handleBatch(ctx context.Context, msg *define.AgentMessage, wireSize int, rawSize int) error {
+	var accepted bool
+	var clients map[string]*client
+	var host string
+	// the targets that got the batch before a later target failed
+	var delivered map[string]bool
+	paths := make(map[string]string)
+	resultSets := make(map[string]string)
+	err := a.co.RunSync(ctx, func(ctx context.Context) error {
+		a.state.Batches++
+		a.state.WireBytes += uint64(wireSize)
+		a.state.RawBytes += uint64(rawSize)
+		accepted = a.state.Accept(msg.Session, msg.Seq, a.logger, a.Key)
+		if accepted {
+			delivered = a.state.Delivered(msg.Session, msg.Seq)
+			for _, record := range msg.Records {
+				if !delivered[record.Target] {
+					a.state.Records[define.AgentFileKey(record.Target, record.Name)]++
+				}
+				if record.Job != "" {
+					if job := a.jobs[record.Job]; job != nil {
+						resultSets[record.Job] = job.status.Request.ResultSet
+					}
+				}
+			}
+		}
+		if accepted && delivered == nil {
+			for _, r := range msg.Rotations {
+				a.logger.Log(logger.LogLevelInfo, "agent receiver file rotated %v %s/%s %s %s source:%s drained:%d", a.Key, r.Target, r.Name, r.Path, r.Kind, r.Source, r.Drained)
+				a.state.Rotated(r)
+			}
+			for key, count := range msg.Dropped {
+				a.state.Dropped[key] += count
+			}
+			for key, count := range msg.Overflow {
+				a.state.Overflow[key] += count
+			}
+		}
+		clients = a.clients
+		if a.state.Agent != nil {
+			host = a.state.Agent.Host
+		}
+		for _, f := range a.files {
+			paths[f.Key()] = f.Path
+		}
+		return nil
+	}, nil)
+	if err != nil || !accepted {
+		return err
+	}
+
+	// the records of the jobs count once they are queued for their result sets
+	queued := make(map[string]uint64)
+	dropped := make(map[string]uint64)
+	done := make(map[string]bool, len(delivered))
+	for target := range delivered {
+		done[target] = true
+	}
+
+	targets := make(map[string][]*define.AgentRecord)
+	var order []string
+	for _, record := range msg.Records {
+		if targets[record.Target] == nil {
+			order = append(order, record.Target)
+		}
+		targets[record.Target] = append(targets[record.Target], record)
+	}
+	for _, target := range order {
+		if done[target] {
+			continue
+		}
+		c := clients[target]
+		if c == nil {
+			a.logger.Log(logger.LogLevelWarning, "agent receiver target not found %v %v records:%d", a.Key, target, len(targets[target]))
+			countJobs(dropped, targets[target])
+			done[target] = true
+			continue
+		}
+		records := make([]*clientRecord, 0, len(targets[target]))
+		for _, record := range targets[target] {
+			resultSet, ok := resultSets[record.Job]
+			if record.Job != "" && !ok {
+				// the job is gone with a manager restart, its result set is unknown
+				continue
+			}
+			records = append(records, &clientRecord{
+				File:   logFileName(record.Name, paths[define.AgentFileKey(record.Target, record.Name)], record.Path),
+				Text:   record.Text,
+				Host:   host,
+				Path:   record.Path,
+				Offset: record.Offset,
+				Inode:  record.Inode,
+				Time:   time.Unix(0, record.Time),
+				Seq:    record.Seq,
+
+				ResultSet: resultSet,
+			})
+		}
+		if len(records) == 0 {
+			done[target] = true
+			continue
+		}
+		err := c.Push(ctx, records)
+		if errors.Is(err, errClientClosed) {
+			countJobs(dropped, targets[target])
+			done[target] = true
+			continue
+		}
+		if err != nil {
+			// the batch is not acked, the agent sends it again and it has to be accepted
+			// then, the targets that got it already are skipped
+			_ = a.co.RunSync(a.ctx, func(ctx context.Context) error {
+				a.countJobs(queued, dropped)
+				a.state.Unaccept(msg.Session, msg.Seq, done)
+				return nil
+			}, nil)
+			return fmt.Errorf("queue records of %s failed, %w", target, err)
+		}
+		countJobs(queued, targets[target])
+		done[target] = true
+	}
+
+	if len(queued) == 0 && len(dropped) == 0 && len(msg.Jobs) == 0 {
+		return nil
+	}
+	return a.co.RunSync(a.ctx, func(ctx context.Context) error {
+		a.countJobs(queued, dropped)
+		for _, job := range msg.Jobs {
+			a.finishJob(job)
+		}
+		return nil
+	}, nil)
+}
+
+// countJobs adds the records queued for the result sets and the ones dropped to the
+// backfill jobs.
+func (a *agent) countJobs(queued map[string]uint64, dropped map[string]uint64) {
+	for id, count := range queued {
+		if job := a.jobs[id]; job != nil {
+			job.status.Records += count
+		}
+	}
+	for id, count := range dropped {
+		if job := a.jobs[id]; job != nil {
+			job.status.Dropped += count
+		}
+	}
+}
+
+// countJobs adds the records of the backfill jobs to counts by job id.
+func countJobs(counts map[string]uint64, records []*define.AgentRecord) {
+	for _, record := range records {
+		if record.Job != "" {
+			counts[record.Job]++
+		}
+	}
+}
+
+// checkBinary tells why a connected agent should upgrade, empty when it runs the binary
+// the host should run.
+func (a *agent) checkBinary(info *define.AgentInfo) string {
+	if a.enrolled() {
+		// an enrolled agent exiting would be started again with the same binary
+		return ""
+	}
+	binary, err := binaries.Find(a.config.AgentBinaryDir, a.binary(), a.agentPlatform())
+	if err != nil {
+		a.logger.Log(logger.LogLevelWarning, "agent check binary failed, key:%s %v", a.Key, err)
+		return ""
+	}
+	if info.Checksum == "" || info.Checksum == binary.Checksum {
+		return ""
+	}
+	if time.Since(a.upgradeTime) < agentUpgradeInterval {
+		a.logger.Log(logger.LogLevelWarning, "agent runs another binary after an upgrade, key:%s version:%s checksum:%s expected:%s %s", a.Key, info.Version, info.Checksum, binary.File, binary.Checksum)
+		return ""
+	}
+	return fmt.Sprintf("version %s checksum %s, %s is %s", info.Version, info.Checksum, binary.File, binary.Checksum)
+}
+
+// agentPlatform is the platform the connected agent reports, or the one detected over ssh.
+func (a *agent) agentPlatform() string {
+	if a.state.Agent != nil && a.state.Agent.Platform != "" {
+		return a.state.Agent.Platform
+	}
+	if a.platform != "" {
+		return a.platform
+	}
+	return defaultAgentPlatform
+}
+
+func (a *agent) sendConfig(conn *websocket.Conn) error {
+	return a.writeMessage(conn, &define.ManagerMessage{Type: define.ManagerMessageConfig, Files: a.files, Compression: a.compression})
+}
+
+func (a *agent) Status() *define.AgentStatus {
+	status := &define.AgentStatus{
+		Key:         a.Key,
+		Connected:   a.connected(),
+		Agent:       a.state.Agent,
+		Gaps:        a.state.Gaps,
+		Duplicates:  a.state.Duplicates,
+		Compression: a.compression,
+		Batches:     a.state.Batches,
+		WireBytes:   a.state.WireBytes,
+		RawBytes:    a.state.RawBytes,
+		Records:     make(map[string]uint64, len(a.state.Records)),
+		Dropped:     make(map[string]uint64, len(a.state.Dropped)),
+		Overflow:    make(map[string]uint64, len(a.state.Overflow)),
+		Rotations:   make(map[string]uint64, len(a.state.Rotations)),
+
+		RecentRotations: append([]*define.AgentRotation(nil), a.state.RecentRotations...),
+
+		Platform:    a.agentPlatform(),
+		Enrolled:    a.enrolled(),
+		Local:       a.isLocal(),
+		HostKey:     a.hostKey,
+		Tunnel:      a.tunnel,
+		Binary:      a.binary(),
+		Upgrades:    a.upgrades,
+		DeployError: a.deployError,
+	}
+	if a.isLocal() {
+		status.Binary = ""
+	} else if binary, err := binaries.Find(a.config.AgentBinaryDir, status.Binary, status.Platform); err == nil {
+		status.Binary, status.Checksum = binary.File, binary.Checksum
+	}
+	for key, count := range a.state.Records {
+		status.Records[key] = count
+	}
+	for key, count := range a.state.Dropped {
+		status.Dropped[key] = count
+	}
+	for key, count := range a.state.Overflow {
+		status.Overflow[key] = count
+	}
+	for key, count := range a.state.Rotations {
+		status.Rotations[key] = count
+	}
+	if status.Compression == "" {
+		status.Compression = define.CompressionNone
+	}
+	if status.WireBytes > 0 {
+		status.CompressionRatio = float64(status.RawBytes) / float64(status.WireBytes)
+	}
+	for target := range a.clients {
+		status.Targets = append(status.Targets, target)
+	}
+	sort.Strings(status.Targets)
+
+	if hb := a.state.Heartbeat; hb != nil {
+		status.Version = hb.Version
+		status.LastHeartbeat = a.state.LastHeartbeat
+		status.HeapBytes = hb.HeapBytes
+		status.SysBytes = hb.SysBytes
+		status.Queued = hb.Queued
+	}
+	now := time.Now()
+	for _, f := range a.files {
+		status.Files = append(status.Files, a.fileStatus(f, now))
+	}
+	return status
+}
+
+// fileStatus tells the liveness of a file entry from the heartbeats of the agent.
+func (a *agent) fileStatus(f *define.AgentFile, now time.Time) *define.FileStatus {
+	status := &define.FileStatus{Target: f.Target, Name: f.Name, State: define.FileConnected}
+	if hb := a.state.Heartbeat; hb != nil {
+		for _, state := range hb.Files {
+			if state.Target != f.Target || state.Name != f.Name {
+				continue
+			}
+			status.Read = state.Read
+			status.Dropped = state.Dropped
+			status.Positions = state.Positions
+			for _, p := range state.Positions {
+				if p.Size > p.Offset {
+					status.Lag += p.Size - p.Offset
+				}
+			}
+		}
+	}
+	if p := a.state.progress[f.Key()]; p != nil {
+		status.LastProgress = p.last
+	}
+
+	lastSeen := a.state.LastHeartbeat
+	if a.connTime.After(lastSeen) {
+		lastSeen = a.connTime
+	}
+	switch {
+	case !a.connected():
+		status.State = define.FileDisconnected
+	case now.Sub(lastSeen) > agentHeartbeatTimeout:
+		status.State = define.FileStalled
+	case status.LastProgress.IsZero():
+		// not in a heartbeat yet
+	case status.Lag > 0 && now.Sub(status.LastProgress) > fileStallTime:
+		status.State = define.FileStalled
+	case status.Lag == 0 && now.Sub(status.LastProgress) > fileIdleTime:
+		status.State = define.FileIdle
+	}
+	return status
+}
+
+// writeMessage is called by the receiver and the agent coroutine, a websocket takes
+// one writer at a time.
+func (a *agent) writeMessage(conn *websocket.Conn, msg *define.ManagerMessage) error {
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	return writeManagerMessage(conn, msg)
+}
+
+func writeManagerMessage(conn *websocket.Conn, msg *define.ManagerMessage) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal manager message failed, %w", err)
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second * 10)); err != nil {
+		return fmt.Errorf("set write dead line failed, %w", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+		return fmt.Errorf("write message failed, %w", err)
+	}
+	return nil
+}
+
+// enrolled reports whether the agent is installed on its host and enrolls itself instead
+// of being started over ssh.
+func (a *agent) enrolled() bool {
+	return define.PullAgentName(a.Key) != ""
+}
+
+// webSocketAddr is the url the agent connects to the manager with, secure is the tls
+// listener of the agents.
+func (a *agent) webSocketAddr(secure bool, host string) string {
+	scheme := "ws"
+	if secure {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s/agentws?agent=%s", scheme, host, url.QueryEscape(a.Key))
+}
+
+// params are the params of a new launch of the agent, it gets a new token every time.
+func (a *agent) params() (*define.AgentParams, error) {
+	token, err := a.mgr.tokens.Issue(a.Key)
+	if err != nil {
+		return nil, err
+	}
+	params := &define.AgentParams{
+		WebSocketAddr: a.webSocketAddr(false, fmt.Sprintf("%s:%d", a.config.Address, a.config.Port)),
+		StateDir:      agentStateDir,
+		Files:         a.files,
+		Compression:   a.compression,
+		Token:         token,
+	}
+	if tlsCfg := a.config.AgentListenerTLS(); tlsCfg != nil {
+		port := a.config.Port
+		if tlsCfg == a.config.AgentTLS {
+			port = tlsCfg.Port
+		}
+		params.WebSocketAddr = a.webSocketAddr(true, fmt.Sprintf("%s:%d", a.config.Address, port))
+		if tlsCfg.CAFile != "" {
+			ca, err := ioutil.ReadFile(tlsCfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("read agent tls ca failed, %w", err)
+			}
+			params.CACert = string(ca)
+		}
+	}
+	// the spool is shared by the files, it takes the largest limit of them
+	for _, target := range a.config.Targets {
+		for _, file := range target.Files {
+			if file.AgentKey() == a.Key && file.SpoolMaxSize > params.SpoolMaxSize {
+				params.SpoolMaxSize = file.SpoolMaxSize
+			}
+		}
+	}
+	return params, nil
+}
+
+func (a *agent) monitor(ctx context.Context) error {
+	startRemoteAgent := func(ctx context.Context, config *define.ConfigLogFileInfo, params *define.AgentParams, name string, binaryDir string) error {
+		var sshClient *sshConn
+		var hostKey string
+		managerConfig := a.config
+		err := a.co.Await(ctx, func(ctx context.Context) (err error) {
+			sshClient, hostKey, err = dialSSH(managerConfig, config, a.logger)
+			return err
+		})
+		if hostKey != "" {
+			a.hostKey = hostKey
+		}
+		if err != nil {
+			a.deployError = err.Error()
+			a.logger.Log(logger.LogLevelError, "agent deploy failed, key:%s %v", a.Key, err)
+			return err
+		}
+
+		// the agent connects back through a reverse tunnel of the ssh connection
+		if a.config.AgentTunnel || config.AgentTunnel || len(config.JumpHosts) > 0 {
+			tunnel, err := a.serveTunnel(sshClient)
+			if err != nil {
+				_ = sshClient.Close()
+				a.deployError = err.Error()
+				a.logger.Log(logger.LogLevelError, "agent deploy failed, key:%s %v", a.Key, err)
+				return err
+			}
+			a.tunnel = tunnel.Addr().String()
+			defer func() {
+				_ = tunnel.Close()
+				a.tunnel = ""
+			}()
+			// the tunnel is encrypted by ssh, the agent reaches the plain websocket through it
+			params.WebSocketAddr = a.webSocketAddr(false, a.tunnel)
+			// the tunnel goes with the session, the next launch opens a new one
+			params.ExitWithSession = true
+			a.logger.Log(logger.LogLevelInfo, "agent reverse tunnel key:%s remote:%s", a.Key, a.tunnel)
+		}
+
+		strParams, err := params.ToString()
+		if err != nil {
+			_ = sshClient.Close()
+			return fmt.Errorf("build agent params failed, %w", err)
+		}
+
+		// the build of the platform of the host is deployed
+		var binary *agentBinary
+		var platform string
+		err = a.co.Await(ctx, func(ctx context.Context) error {
+			output, err := sshClient.Output("uname -sm")
+			if err != nil {
+				return fmt.Errorf("detect platform failed, %w", err)
+			}
+			platform, err = parseUname(string(output))
+			if err != nil {
+				return fmt.Errorf("detect platform failed, %w", err)
+			}
+			binary, err = binaries.Find(binaryDir, name, platform)
+			if err != nil {
+				return err
+			}
+			return a.uploadBinary(sshClient, config.AgentDir, binary)
+		})
+		a.platform = platform
+		if err != nil {
+			_ = sshClient.Close()
+			a.deployError = err.Error()
+			a.logger.Log(logger.LogLevelError, "agent deploy failed, key:%s %v", a.Key, err)
+			return err
+		}
+		a.deployError = ""
+
+		// the params carry the token, they go on stdin to stay out of the remote process list
+		remote := remoteAgentPath(config.AgentDir)
+		a.logger.Log(logger.LogLevelDebug, "agent start ssh key:%s agent:%s", a.Key, remote)
+
+		// stdin stays open while the session lasts, the agent sees its end there
+		stdin, stdinWriter := io.Pipe()
+		go func() {
+			_, _ = io.WriteString(stdinWriter, strParams+"\n")
+		}()
+		err = a.co.Await(ctx, func(ctx context.Context) error {
+			defer sshClient.Close()
+			defer stdinWriter.Close()
+			return sshClient.RunInput(shellQuote(remote), stdin, a, a)
+		})
+		if err != nil {
+			a.deployError = fmt.Sprintf("agent run failed, %v", err)
+			a.logger.Log(logger.LogLevelError, "agent run failed, key:%s %v", a.Key, err)
+			return err
+		}
+		return nil
+	}
+
+	for {
+		// the enrolled agents are started on their hosts
+		if a.conn == nil && len(a.files) > 0 && !a.enrolled() {
+			config, binary, binaryDir := a.ssh, a.binary(), a.config.AgentBinaryDir
+			params, err := a.params()
+			if err != nil {
+				a.deployError = err.Error()
+				a.logger.Log(logger.LogLevelError, "agent deploy failed, key:%s %v", a.Key, err)
+				a.co.Sleep(ctx, defaultReloadConfig)
+				continue
+			}
+			_ = a.co.RunAsync(a.ctx, func(ctx context.Context) error {
+				a.logger.Log(logger.LogLevelDebug, "agent start ssh remote agent key:%s files:%d binary:%s", a.Key, len(params.Files), binary)
+				err := startRemoteAgent(ctx, config, params, binary, binaryDir)
+				a.logger.Log(logger.LogLevelDebug, "agent start ssh remote agent finish key:%s %v", a.Key, err)
+				return nil
+			}, nil)
+		}
+
+		a.co.Sleep(ctx, defaultReloadConfig)
+	}
+}
+
+func (a *agent) Write(p []byte) (n int, err error) {
+	a.logger.Log(logger.LogLevelDebug, "=====> agent output:%s", string(p))
+	return len(p), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lsg2020/logfilter/logger"
+)
+
+func testLogger(t *testing.T) logger.Log {
+	l, err := logger.NewLogger("test--->", logger.LogLevelError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestAgentStateAccept(t *testing.T) {
+	type batch struct {
+		session string
+		seq     uint64
+		accept  bool
+	}
+	tests := []struct {
+		name       string
+		batches    []batch
+		duplicates uint64
+		gaps       uint64
+	}{
+		{
+			name:    "in order",
+			batches: []batch{{"a", 1, true}, {"a", 2, true}, {"a", 3, true}},
+		},
+		{
+			name:       "replayed",
+			batches:    []batch{{"a", 1, true}, {"a", 2, true}, {"a", 1, false}, {"a", 2, false}, {"a", 3, true}},
+			duplicates: 2,
+		},
+		{
+			name:       "gap",
+			batches:    []batch{{"a", 1, true}, {"a", 4, true}, {"a", 3, false}},
+			duplicates: 1,
+			gaps:       1,
+		},
+		{
+			name:       "sessions",
+			batches:    []batch{{"a", 5, true}, {"b", 1, true}, {"a", 6, true}, {"b", 1, false}},
+			duplicates: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as := &agentState{sessions: make(map[string]uint64)}
+			for i, b := range tt.batches {
+				if accept := as.Accept(b.session, b.seq, testLogger(t), "test"); accept != b.accept {
+					t.Errorf("batch %d %s:%d accepted %v, want %v", i, b.session, b.seq, accept, b.accept)
+				}
+			}
+			if as.Duplicates != tt.duplicates || as.Gaps != tt.gaps {
+				t.Errorf("duplicates %d gaps %d, want %d %d", as.Duplicates, as.Gaps, tt.duplicates, tt.gaps)
+			}
+		})
+	}
+}
+
+func TestAgentStateSessions(t *testing.T) {
+	as := &agentState{sessions: make(map[string]uint64)}
+	for i := 0; i <= maxAgentSessions; i++ {
+		as.Accept(fmt.Sprintf("s%d", i), 1, testLogger(t), "test")
+	}
+	// the oldest session is forgotten, its batches count as new again
+	if !as.Accept("s0", 1, testLogger(t), "test") {
+		t.Error("batch of a forgotten session not accepted")
+	}
+	if as.Accept(fmt.Sprintf("s%d", maxAgentSessions), 1, testLogger(t), "test") {
+		t.Error("duplicate batch of a recent session accepted")
+	}
+}
+
+func TestAgentStateUnaccept(t *testing.T) {
+	as := &agentState{sessions: make(map[string]uint64)}
+	as.Accept("a", 1, testLogger(t), "test")
+	as.Accept("a", 2, testLogger(t), "test")
+	as.Unaccept("a", 2, map[string]bool{"t1": true})
+
+	// the replay of the batch is accepted and skips the targets that got it
+	if !as.Accept("a", 2, testLogger(t), "test") {
+		t.Fatal("replayed batch not accepted")
+	}
+	if delivered := as.Delivered("a", 2); !delivered["t1"] || len(delivered) != 1 {
+		t.Errorf("delivered %v, want t1", delivered)
+	}
+	if delivered := as.Delivered("a", 2); delivered != nil {
+		t.Errorf("delivered %v twice", delivered)
+	}
+
+	// an older batch is not unaccepted
+	as.Unaccept("a", 1, nil)
+	if as.Accept("a", 2, testLogger(t), "test") {
+		t.Error("batch accepted twice")
+	}
+}
+
+func TestStopAgentScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		pid     int
+		dir     string
+		cleanup bool
+		want    []string
+		not     []string
+	}{
+		{"stop", 42, "", false, []string{"ps -p 42 ", "grep -q LogFilterAgent", "kill 42", "kill -9 42"}, []string{"rm -rf"}},
+		{"stop and cleanup", 42, "bin", true, []string{"kill 42", "rm -rf 'bin/LogFilterAgent' 'bin/LogFilterAgent.upload' '.logfilter'"}, nil},
+		{"cleanup without pid", 0, "", true, []string{"rm -rf './LogFilterAgent'"}, []string{"kill"}},
+		{"nothing", 0, "", false, nil, []string{"kill", "rm -rf"}},
+	}
+	for _, tt := range tests {
+		script := stopAgentScript(tt.pid, tt.dir, tt.cleanup)
+		for _, s := range tt.want {
+			if !strings.Contains(script, s) {
+				t.Errorf("%s: script %q without %q", tt.name, script, s)
+			}
+		}
+		for _, s := range tt.not {
+			if strings.Contains(script, s) {
+				t.Errorf("%s: script %q with %q", tt.name, script, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lsg2020/goco"
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	// finished backfill jobs kept for the backfill api of each agent
+	maxAgentJobs = 64
+)
+
+// backfillJob is a backfill job run by an agent, it belongs to the agent session that
+// received it and fails when that session is gone.
+type backfillJob struct {
+	status  *define.BackfillStatus
+	session string
+}
+
+// StartBackfill sends a backfill job to the agent, it needs a connected agent.
+func (a *agent) StartBackfill(job *define.BackfillJob, r func(*define.BackfillStatus, error)) {
+	var status *define.BackfillStatus
+	err := a.co.RunAsync(a.ctx, func(ctx context.Context) error {
+		var file *define.AgentFile
+		for _, f := range a.files {
+			if f.Key() == job.File.Key() {
+				file = f
+			}
+		}
+		if file == nil {
+			return fmt.Errorf("agent file not found, key:%s file:%s", a.Key, job.File.Key())
+		}
+		job.File = file
+		if a.isLocal() {
+			return fmt.Errorf("backfill of local files not supported, key:%s", a.Key)
+		}
+		if a.conn == nil || a.state.Agent == nil {
+			return fmt.Errorf("agent not connected, key:%s", a.Key)
+		}
+		if err := a.writeMessage(a.conn, &define.ManagerMessage{Type: define.ManagerMessageBackfill, Job: job}); err != nil {
+			return fmt.Errorf("send backfill job failed, %w", err)
+		}
+
+		status = &define.BackfillStatus{
+			ID:      job.ID,
+			Agent:   a.Key,
+			Request: &job.BackfillRequest,
+			State:   define.BackfillRunning,
+			Started: time.Now(),
+		}
+		a.addJob(&backfillJob{status: status, session: a.state.Agent.Session})
+		a.logger.Log(logger.LogLevelInfo, "agent start backfill key:%s job:%s %s/%s", a.Key, job.ID, job.Target, job.File.Name)
+		return nil
+	}, &co.RunOptions{Result: func(err error) {
+		r(status, err)
+	}})
+	if err != nil {
+		r(nil, err)
+	}
+}
+
+func (a *agent) addJob(job *backfillJob) {
+	a.jobs[job.status.ID] = job
+	a.jobOrder = append(a.jobOrder, job.status.ID)
+	// forget the oldest finished jobs, the running ones are kept
+	for i := 0; len(a.jobs) > maxAgentJobs && i < len(a.jobOrder); {
+		id := a.jobOrder[i]
+		if a.jobs[id].status.State == define.BackfillRunning {
+			i++
+			continue
+		}
+		delete(a.jobs, id)
+		a.jobOrder = append(a.jobOrder[:i], a.jobOrder[i+1:]...)
+	}
+}
+
+// failJobs fails the running jobs of the agent sessions other than session, a restarted
+// agent does not go on with them.
+func (a *agent) failJobs(session string) {
+	for _, job := range a.jobs {
+		if job.status.State == define.BackfillRunning && job.session != session {
+			job.status.State = define.BackfillFailed
+			job.status.Error = "agent restarted"
+			job.status.Finished = time.Now()
+		}
+	}
+}
+
+func (a *agent) finishJob(s *define.AgentJobStatus) {
+	job := a.jobs[s.ID]
+	if job == nil {
+		a.logger.Log(logger.LogLevelWarning, "agent backfill job not found key:%s job:%s", a.Key, s.ID)
+		return
+	}
+	job.status.State = define.BackfillDone
+	if s.Error != "" {
+		job.status.State = define.BackfillFailed
+		job.status.Error = s.Error
+	}
+	job.status.Files = s.Files
+	job.status.Filtered = s.Filtered
+	job.status.Finished = time.Now()
+	a.logger.Log(logger.LogLevelInfo, "agent backfill finish key:%s job:%s state:%s records:%d", a.Key, s.ID, job.status.State, job.status.Records)
+}
+
+func (a *agent) Backfills() []*define.BackfillStatus {
+	res := make([]*define.BackfillStatus, 0, len(a.jobOrder))
+	for _, id := range a.jobOrder {
+		status := *a.jobs[id].status
+		res = append(res, &status)
+	}
+	return res
+}
+
+// StartBackfill starts a backfill job on the agent of the target file.
+func (mgr *manager) StartBackfill(ctx context.Context, req *define.BackfillRequest) (*define.BackfillStatus, error) {
+	if err := req.Check(); err != nil {
+		return nil, err
+	}
+
+	var status *define.BackfillStatus
+	err := mgr.co.RunSync(ctx, func(ctx context.Context) error {
+		target := mgr.config.GetTarget(req.Target)
+		if target == nil || !target.Open {
+			return fmt.Errorf("target not found or closed: %s", req.Target)
+		}
+		file := mgr.config.GetTargetFile(req.Target, req.File)
+		if file == nil {
+			return fmt.Errorf("target file not found: %s %s", req.Target, req.File)
+		}
+		a := mgr.agents[file.AgentKey()]
+		if a == nil {
+			return fmt.Errorf("agent not found: %s", file.AgentKey())
+		}
+
+		job := &define.BackfillJob{
+			ID:              fmt.Sprintf("%x", time.Now().UnixNano()),
+			File:            &define.AgentFile{Target: req.Target, Name: req.File},
+			BackfillRequest: *req,
+		}
+		sessionID := mgr.co.PrepareWait()
+		a.StartBackfill(job, func(s *define.BackfillStatus, err error) {
+			status = s
+			mgr.co.Wakeup(sessionID, err)
+		})
+		return mgr.co.Wait(ctx, sessionID)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// LoadBackfills lists the backfill jobs of every agent, the latest first.
+func (mgr *manager) LoadBackfills(ctx context.Context) ([]*define.BackfillStatus, error) {
+	var res []*define.BackfillStatus
+	err := mgr.co.RunSync(ctx, func(ctx context.Context) error {
+		for key, a := range mgr.agents {
+			var jobs []*define.BackfillStatus
+			sessionID := mgr.co.PrepareWait()
+			a.co.RunAsync(a.ctx, func(ctx context.Context) error {
+				jobs = a.Backfills()
+				return nil
+			}, &co.RunOptions{Result: func(err error) {
+				mgr.co.Wakeup(sessionID, err)
+			}})
+			err := mgr.co.Wait(ctx, sessionID)
+			if err != nil {
+				return fmt.Errorf("load agent backfills failed, agent:%s %w", key, err)
+			}
+			res = append(res, jobs...)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Started.After(res[j].Started) })
+	return res, nil
+}
+
+// DeleteResultSet frees the filters of a backfill result set.
+func (mgr *manager) DeleteResultSet(ctx context.Context, targetID string, name string) error {
+	return mgr.co.RunSync(ctx, func(ctx context.Context) error {
+		c := mgr.getClient(targetID)
+		if c == nil {
+			return fmt.Errorf("target not found: %s", targetID)
+		}
+		sessionID := mgr.co.PrepareWait()
+		c.co.RunAsync(c.ctx, func(ctx context.Context) error {
+			return c.DeleteResultSet(name)
+		}, &co.RunOptions{Result: func(err error) {
+			mgr.co.Wakeup(sessionID, err)
+		}})
+		return mgr.co.Wait(ctx, sessionID)
+	}, nil)
+}
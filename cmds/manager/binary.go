@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	defaultAgentBinary = "LogFilterAgent"
+	// the file name of the agent on the remote hosts, whatever build it is
+	remoteAgentFile = "LogFilterAgent"
+	// the platform of the agent builds without a platform suffix
+	defaultAgentPlatform = "linux/amd64"
+)
+
+// uname -s and uname -m outputs mapped to GOOS and GOARCH
+var (
+	unameSystems = map[string]string{
+		"linux":   "linux",
+		"darwin":  "darwin",
+		"freebsd": "freebsd",
+		"openbsd": "openbsd",
+		"netbsd":  "netbsd",
+		"sunos":   "solaris",
+		"aix":     "aix",
+	}
+	unameMachines = map[string]string{
+		"x86_64":  "amd64",
+		"amd64":   "amd64",
+		"i386":    "386",
+		"i486":    "386",
+		"i586":    "386",
+		"i686":    "386",
+		"aarch64": "arm64",
+		"arm64":   "arm64",
+		"armv5l":  "arm",
+		"armv6l":  "arm",
+		"armv7l":  "arm",
+		"armv8l":  "arm",
+		"ppc64le": "ppc64le",
+		"ppc64":   "ppc64",
+		"s390x":   "s390x",
+		"mips":    "mips",
+		"mips64":  "mips64",
+		"riscv64": "riscv64",
+	}
+)
+
+// parseUname turns the output of `uname -sm` into a GOOS/GOARCH platform.
+func parseUname(output string) (string, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("unexpected uname output %q", strings.TrimSpace(output))
+	}
+	system, ok := unameSystems[strings.ToLower(fields[0])]
+	if !ok {
+		return "", fmt.Errorf("unknown system %s", fields[0])
+	}
+	machine, ok := unameMachines[strings.ToLower(fields[1])]
+	if !ok {
+		return "", fmt.Errorf("unknown machine %s", fields[1])
+	}
+	return system + "/" + machine, nil
+}
+
+// agentBinaryFile is the name of the build of an agent binary for a platform, like
+// LogFilterAgent-linux-arm64.
+func agentBinaryFile(name string, platform string) string {
+	return name + "-" + strings.Replace(platform, "/", "-", 1)
+}
+
+// agentBinary is one agent build found in the binary dir or in static.
+type agentBinary struct {
+	File     string
+	Checksum string
+	size     int64
+	// the file in the binary dir, empty for the embedded builds
+	path    string
+	modTime time.Time
+}
+
+// agentBinaries finds the agent builds of each platform and caches their checksums, the
+// remote hosts skip the download when theirs already matches. The builds are looked up
+// in the configured binary dir first and then in static.
+type agentBinaries struct {
+	mu     sync.Mutex
+	cached map[string]*agentBinary
+}
+
+var binaries = &agentBinaries{cached: make(map[string]*agentBinary)}
+
+// Find returns the build of an agent binary for a platform.
+func (b *agentBinaries) Find(dir string, name string, platform string) (*agentBinary, error) {
+	files := []string{agentBinaryFile(name, platform)}
+	if platform == defaultAgentPlatform {
+		files = append(files, name)
+	}
+	for _, file := range files {
+		binary, err := b.Get(dir, file)
+		if err == nil {
+			return binary, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	where := "static"
+	if dir != "" {
+		where = fmt.Sprintf("%s and static", dir)
+	}
+	return nil, fmt.Errorf("no agent build of %s for %s, looked for %s in %s", name, platform, strings.Join(files, ","), where)
+}
+
+// Get returns an agent build by its file name.
+func (b *agentBinaries) Get(dir string, file string) (*agentBinary, error) {
+	if file == "" || strings.ContainsAny(file, `/\`) {
+		return nil, os.ErrNotExist
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if dir != "" {
+		p := filepath.Join(dir, file)
+		info, err := os.Stat(p)
+		if err == nil && !info.IsDir() {
+			cached := b.cached[p]
+			if cached != nil && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+				return cached, nil
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return nil, fmt.Errorf("open agent binary failed, %w", err)
+			}
+			defer f.Close()
+			binary, err := newAgentBinary(file, f)
+			if err != nil {
+				return nil, err
+			}
+			binary.path, binary.modTime = p, info.ModTime()
+			b.cached[p] = binary
+			return binary, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("stat agent binary failed, %w", err)
+		}
+	}
+
+	p := path.Join("static", file)
+	if cached := b.cached[p]; cached != nil {
+		return cached, nil
+	}
+	f, err := staticFileSystem.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("open agent binary failed, %w", err)
+	}
+	defer f.Close()
+	binary, err := newAgentBinary(file, f)
+	if err != nil {
+		return nil, err
+	}
+	b.cached[p] = binary
+	return binary, nil
+}
+
+// Open opens the content of an agent build.
+func (b *agentBinaries) Open(binary *agentBinary) (io.ReadCloser, error) {
+	if binary.path != "" {
+		return os.Open(binary.path)
+	}
+	return staticFileSystem.Open(path.Join("static", binary.File))
+}
+
+func newAgentBinary(file string, r io.Reader) (*agentBinary, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return nil, fmt.Errorf("read agent binary failed, %w", err)
+	}
+	return &agentBinary{File: file, Checksum: hex.EncodeToString(h.Sum(nil)), size: size}, nil
+}
+
+// remoteAgentPath is the path of the agent on the remote host, the login dir keeps it
+// when no agent dir is configured.
+func remoteAgentPath(dir string) string {
+	if dir == "" {
+		return "./" + remoteAgentFile
+	}
+	return path.Join(dir, remoteAgentFile)
+}
+
+// uploadBinary copies an agent build over the ssh connection unless the remote agent
+// already has its checksum. The upload is renamed over the agent at the end so a running
+// agent keeps its file and a broken upload does not replace it.
+func (a *agent) uploadBinary(client *sshConn, dir string, binary *agentBinary) error {
+	remote := remoteAgentPath(dir)
+	// a host without sha256sum gets the binary on every start
+	output, _ := client.Output(fmt.Sprintf("sha256sum %s 2>/dev/null", shellQuote(remote)))
+	if fields := strings.Fields(string(output)); len(fields) > 0 && fields[0] == binary.Checksum {
+		return nil
+	}
+
+	if dir == "" {
+		dir = "."
+	} else if err := client.Run("mkdir -p "+shellQuote(dir), nil, nil); err != nil {
+		return fmt.Errorf("create remote agent dir %s failed, %w", dir, err)
+	}
+	f, err := binaries.Open(binary)
+	if err != nil {
+		return fmt.Errorf("open agent binary failed, %w", err)
+	}
+	defer f.Close()
+
+	a.logger.Log(logger.LogLevelInfo, "agent upload binary key:%s %s -> %s checksum:%s", a.Key, binary.File, remote, binary.Checksum)
+	upload := remoteAgentFile + ".upload"
+	if err := scpUpload(client.Client(), dir, upload, 0755, binary.size, f); err != nil {
+		return fmt.Errorf("upload agent binary failed, %w", err)
+	}
+	if err := client.Run(fmt.Sprintf("mv -f %s %s", shellQuote(path.Join(dir, upload)), shellQuote(remote)), nil, nil); err != nil {
+		return fmt.Errorf("replace remote agent failed, %w", err)
+	}
+	return nil
+}
+
+// binary is the agent binary the host runs, the canary one when any of its targets is
+// in the canary rollout.
+func (a *agent) binary() string {
+	canary := a.config.AgentCanary
+	if canary == nil || canary.Binary == "" {
+		return defaultAgentBinary
+	}
+	for _, target := range canary.Targets {
+		if a.clients[target] != nil {
+			return canary.Binary
+		}
+	}
+	return defaultAgentBinary
+}
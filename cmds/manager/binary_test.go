@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestParseUname(t *testing.T) {
+	tests := []struct {
+		output   string
+		platform string
+	}{
+		{"Linux x86_64\n", "linux/amd64"},
+		{"Linux aarch64", "linux/arm64"},
+		{"Linux armv7l\n", "linux/arm"},
+		{"Darwin arm64\n", "darwin/arm64"},
+		{"FreeBSD amd64\n", "freebsd/amd64"},
+		{"Linux\n", ""},
+		{"SunOS i86pc\n", ""},
+		{"Linux sparc64\n", ""},
+	}
+	for _, tt := range tests {
+		platform, err := parseUname(tt.output)
+		if platform != tt.platform || (err == nil) != (tt.platform != "") {
+			t.Errorf("parse %q = %q %v, want %q", tt.output, platform, err, tt.platform)
+		}
+	}
+}
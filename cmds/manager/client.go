@@ -2,20 +2,25 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/helloyi/go-sshclient"
 	"github.com/lsg2020/goco"
 	"github.com/lsg2020/logfilter/define"
 	"github.com/lsg2020/logfilter/logger"
 )
 
+var errClientClosed = errors.New("client closed")
+
 type client struct {
+	// updated atomically, kept first for the 64 bit alignment
+	processed uint64
+	dropped   uint64
+
 	ID     string
 	config *define.Config
 	logger logger.Log
@@ -25,9 +30,28 @@ type client struct {
 	mgr    *manager
 
 	filters map[string]*filterData
+	// fresh instances of the filters fed by backfill jobs, keyed by result set name
+	resultSets map[string]map[string]*filterData
+
+	queue chan []*clientRecord
+}
+
+const (
+	defaultClientQueueSize = 256
+)
 
-	fileConns   map[string]*websocket.Conn
-	fileCancels map[string]context.CancelFunc
+// clientRecord is a log line waiting in the queue for the filters of a target
+type clientRecord struct {
+	File   string
+	Text   string
+	Host   string
+	Path   string
+	Offset int64
+	Inode  uint64
+	Time   time.Time
+	Seq    uint64
+	// backfill result set of the record, empty for the normal records
+	ResultSet string
 }
 
 func (c *client) Start(r func(error)) {
@@ -36,12 +60,6 @@ func (c *client) Start(r func(error)) {
 	err := c.co.RunAsync(c.ctx, c.start, &co.RunOptions{Result: r})
 	if err != nil {
 		r(err)
-		return
-	}
-	err = c.co.RunAsync(c.ctx, c.monitor, &co.RunOptions{})
-	if err != nil {
-		r(err)
-		return
 	}
 }
 
@@ -61,155 +79,80 @@ func (c *client) Close() {
 	c.cancel()
 }
 
-func (c *client) BindAgentWS(conn *websocket.Conn, filename string, r func(error)) {
-	err := c.co.RunAsync(c.ctx, func(ctx context.Context) error {
-		if c.fileCancels[filename] != nil {
-			c.fileCancels[filename]()
-		}
+// Push queues records for the filters, the agent receivers of every host push to the
+// queue of a target and the worker runs the filters in the client coroutine. A full queue
+// holds the receiver back until ctx is done, the agent keeps the batches it has not got
+// an ack for. The records of a closed client are dropped with errClientClosed.
+func (c *client) Push(ctx context.Context, records []*clientRecord) error {
+	select {
+	case c.queue <- records:
+		return nil
+	default:
+	}
 
-		ctx, cancel := context.WithCancel(c.ctx)
-		c.fileCancels[filename] = cancel
-		c.fileConns[filename] = conn
-		go c.receiver(ctx, filename, conn)
+	c.logger.Log(logger.LogLevelDebug, "client queue full, wait id:%s records:%d", c.ID, len(records))
+	select {
+	case c.queue <- records:
 		return nil
-	}, &co.RunOptions{Result: r})
-	if err != nil {
-		r(err)
+	case <-c.ctx.Done():
+		atomic.AddUint64(&c.dropped, uint64(len(records)))
+		return errClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (c *client) receiver(ctx context.Context, filename string, conn *websocket.Conn) {
-	defer func() {
-		c.logger.Log(logger.LogLevelDebug, "client finish receiver %v %v %v", c.ID, filename, conn.RemoteAddr().String())
-		_ = conn.Close()
-		_ = c.co.RunAsync(ctx, func(ctx context.Context) error {
-			if c.fileConns[filename] == conn {
-				c.fileConns[filename] = nil
-				c.fileCancels[filename]()
-				c.fileCancels[filename] = nil
-			}
-			return nil
-		}, nil)
-	}()
-
-	c.logger.Log(logger.LogLevelDebug, "client start receiver %v %v %v", c.ID, filename, conn.RemoteAddr().String())
+func (c *client) worker() {
 	for {
-		if err := conn.SetReadDeadline(time.Now().Add(time.Second * 10)); err != nil {
-			c.logger.Log(logger.LogLevelDebug, "client receiver set read dead line failed %v %v %v %v", c.ID, filename, conn.RemoteAddr().String(), err)
-			return
-		}
-
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			c.logger.Log(logger.LogLevelDebug, "client receiver read message failed %v %v %v %v", c.ID, filename, conn.RemoteAddr().String(), err)
-			return
-		}
-
-		var lines []string
-		err = json.Unmarshal(message, &lines)
-		if err != nil {
-			c.logger.Log(logger.LogLevelDebug, "client receiver read message unmarshal failed %v %v %v %v", c.ID, filename, conn.RemoteAddr().String(), err)
-			return
-		}
-
-		_ = c.co.RunAsync(ctx, func(ctx context.Context) error {
-			for _, line := range lines {
-				c.filterLogger(filename, line)
-			}
-			return nil
-		}, nil)
-
 		select {
-		case <-ctx.Done():
-			c.logger.Log(logger.LogLevelDebug, "client receiver ctx done %v %v %v %v", c.ID, filename, conn.RemoteAddr().String(), ctx.Err())
+		case records := <-c.queue:
+			err := c.co.RunSync(c.ctx, func(ctx context.Context) error {
+				for _, record := range records {
+					c.filterLogger(record)
+				}
+				return nil
+			}, nil)
+			if err != nil {
+				c.logger.Log(logger.LogLevelWarning, "client worker filter failed, client_id:%s %v", c.ID, err)
+			}
+			atomic.AddUint64(&c.processed, uint64(len(records)))
+		case <-c.ctx.Done():
 			return
-		default:
 		}
 	}
-
 }
 
-func (c *client) monitor(ctx context.Context) error {
-	startRemoteAgent := func(ctx context.Context, config *define.ConfigLogFileInfo) error {
-		var sshClient *sshclient.Client
-		var err error
-		if config.SshPwd != "" {
-			sshClient, err = sshclient.DialWithPasswd(fmt.Sprintf("%s:%d", config.SshHost, config.SshPort), config.SshUser, config.SshPwd)
-		} else {
-			tokenFile := fmt.Sprintf("ssh_token_%s_%s", c.ID, config.Name)
-			err = c.co.Await(ctx, func(ctx context.Context) error {
-				return ioutil.WriteFile(tokenFile, []byte(config.SshKey), 0600)
-			})
-			if err != nil {
-				c.logger.Log(logger.LogLevelError, "write ssh token failed, id:%s %v %v", c.ID, config.Name, err)
-				return fmt.Errorf("write ssh token failed %w", err)
-			}
-			sshClient, err = sshclient.DialWithKey(fmt.Sprintf("%s:%d", config.SshHost, config.SshPort), config.SshUser, tokenFile)
-		}
-		if err != nil {
-			return fmt.Errorf("ssh dial failed, %w", err)
-		}
-
-		params := &define.AgentParams{
-			WebSocketAddr: fmt.Sprintf("ws://%s:%d/agentws?id=%s&file=%s", c.config.Address, c.config.Port, c.ID, config.Name),
-			LogPath:       config.Path,
-		}
-		strParams, err := params.ToString()
-		if err != nil {
-			return fmt.Errorf("build agent params failed, %w", err)
-		}
-
-		agentDownloadUrl := fmt.Sprintf("http://%s:%d/static/LogFilterAgent", c.config.Address, c.config.Port)
-		cmdDownload := fmt.Sprintf("curl -u %s:%s -o LogFilterAgent %s && chmod +x LogFilterAgent", c.config.AdminUser, c.config.AdminPwd, agentDownloadUrl)
-		cmdRun := fmt.Sprintf("./LogFilterAgent %s", strParams)
-
-		c.logger.Log(logger.LogLevelDebug, "client start ssh agent id:%s file:%s cmd:%s\n%s", c.ID, config.Name, cmdDownload, cmdRun)
-
-		err = c.co.Await(ctx, func(ctx context.Context) error {
-			defer sshClient.Close()
-			_ = sshClient.Script(cmdDownload).Run()
-			err = sshClient.Script(cmdRun).SetStdio(c, c).Run()
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-		return nil
+func (c *client) Status() *define.ClientStatus {
+	return &define.ClientStatus{
+		ID:        c.ID,
+		QueueSize: cap(c.queue),
+		Queued:    len(c.queue),
+		Processed: atomic.LoadUint64(&c.processed),
+		Dropped:   atomic.LoadUint64(&c.dropped),
 	}
+}
 
-	for {
-		cfg := c.config.GetTarget(c.ID)
-		if cfg == nil {
-			c.logger.Log(logger.LogLevelError, "client monitor config not found id:%s", c.ID)
-			goto sleep
-		}
-
-		for _, file := range cfg.Files {
-			config := file
-			if !cfg.Open || c.fileConns[config.Name] != nil {
-				continue
-			}
-
-			_ = c.co.RunAsync(c.ctx, func(ctx context.Context) error {
-				c.logger.Log(logger.LogLevelDebug, "client start ssh remote agent id:%s file:%s", c.ID, config.Name)
-				err := startRemoteAgent(ctx, config)
-				c.logger.Log(logger.LogLevelDebug, "client start ssh remote agent finish id:%s file:%s %v", c.ID, config.Name, err)
-				return nil
-			}, nil)
-		}
-
-	sleep:
-		c.co.Sleep(ctx, defaultReloadConfig)
+// splitResultSet splits a target name of the grafana queries into the target id and
+// the backfill result set.
+func splitResultSet(target string) (string, string) {
+	if i := strings.Index(target, define.ResultSetSeparator); i >= 0 {
+		return target[:i], target[i+len(define.ResultSetSeparator):]
 	}
+	return target, ""
 }
 
-func (c *client) Write(p []byte) (n int, err error) {
-	c.logger.Log(logger.LogLevelDebug, "=====> agent output:%s", string(p))
-	return len(p), nil
+// logFileName is the file name the filters see, the files found by a glob or directory
+// path are told apart by their own path.
+func logFileName(filename string, cfgPath string, path string) string {
+	if cfgPath == "" || path == "" || path == cfgPath {
+		return filename
+	}
+	return fmt.Sprintf("%s:%s", filename, path)
 }
 
 func (c *client) start(ctx context.Context) error {
 	c.filters = make(map[string]*filterData)
+	c.resultSets = make(map[string]map[string]*filterData)
 
 	err := c.build(c.config)
 	if err != nil {
@@ -226,35 +169,39 @@ func (c *client) reload(config *define.Config) error {
 		c.logger.Log(logger.LogLevelError, "client start failed, client_id:%s %v", c.ID, err)
 		return err
 	}
+	return nil
+}
 
-	cfg := config.GetTarget(c.ID)
-	for name, cancel := range c.fileCancels {
-		if cancel != nil && (cfg == nil || !cfg.Open || config.GetTargetFile(c.ID, name) == nil) {
-			cancel()
-		}
+func (c *client) build(config *define.Config) error {
+	filters, err := c.loadFilters(config)
+	if err != nil {
+		return err
 	}
+
+	c.config = config
+	c.filters = filters
 	return nil
 }
 
-func (c *client) build(config *define.Config) error {
+func (c *client) loadFilters(config *define.Config) (map[string]*filterData, error) {
 	cfg := config.GetTarget(c.ID)
 	if cfg == nil {
-		return fmt.Errorf("client config not found")
+		return nil, fmt.Errorf("client config not found")
 	}
 
 	filters := make(map[string]*filterData)
 	for _, filterID := range cfg.Filters {
 		cfgFilter := config.GetFilter(filterID)
 		if cfgFilter == nil {
-			return fmt.Errorf("client config filter not found id:%s", filterID)
+			return nil, fmt.Errorf("client config filter not found id:%s", filterID)
 		}
 		i, err := LoadScript(cfgFilter.Script)
 		if err != nil {
-			return fmt.Errorf("client config load base script failed, id:%s, %w", filterID, err)
+			return nil, fmt.Errorf("client config load base script failed, id:%s, %w", filterID, err)
 		}
 		f, err := LoadScriptEntryFunction(i, cfgFilter.EntryFunc)
 		if err != nil {
-			return fmt.Errorf("client config load base script failed, id:%s, %w", filterID, err)
+			return nil, fmt.Errorf("client config load base script failed, id:%s, %w", filterID, err)
 		}
 
 		filters[filterID] = &filterData{
@@ -263,28 +210,66 @@ func (c *client) build(config *define.Config) error {
 			EntryFunc: f,
 		}
 	}
+	return filters, nil
+}
 
-	c.config = config
-	c.filters = filters
+// getResultSet returns the filters of a backfill result set, they are created with the
+// filters of the target when the first record arrives and kept across reloads.
+func (c *client) getResultSet(name string, create bool) map[string]*filterData {
+	if name == "" {
+		return c.filters
+	}
+	filters := c.resultSets[name]
+	if filters == nil && create {
+		var err error
+		filters, err = c.loadFilters(c.config)
+		if err != nil {
+			c.logger.Log(logger.LogLevelError, "client create result set failed, client_id:%s result_set:%s %v", c.ID, name, err)
+			return nil
+		}
+		c.logger.Log(logger.LogLevelInfo, "client create result set, client_id:%s result_set:%s", c.ID, name)
+		c.resultSets[name] = filters
+	}
+	return filters
+}
+
+func (c *client) ResultSets() []string {
+	names := make([]string, 0, len(c.resultSets))
+	for name := range c.resultSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *client) DeleteResultSet(name string) error {
+	if c.resultSets[name] == nil {
+		return fmt.Errorf("result set not found, client:%s result_set:%s", c.ID, name)
+	}
+	delete(c.resultSets, name)
 	return nil
 }
 
-func (c *client) LoadFilters() ([]string, error) {
-	filters := make([]*filterData, 0, len(c.filters))
-	for _, f := range c.filters {
+func (c *client) LoadFilters(resultSet string) ([]string, error) {
+	set := c.getResultSet(resultSet, false)
+	if set == nil {
+		return nil, fmt.Errorf("result set not found, client:%s result_set:%s", c.ID, resultSet)
+	}
+	filters := make([]*filterData, 0, len(set))
+	for _, f := range set {
 		filters = append(filters, f)
 	}
 	sort.Slice(filters, func(i, j int) bool { return filters[i].ID > filters[j].ID })
 
-	res := make([]string, 0, len(c.filters))
+	res := make([]string, 0, len(set))
 	for _, f := range filters {
 		res = append(res, f.ID)
 	}
 	return res, nil
 }
 
-func (c *client) LoadTargetSubFilter(searchFilter string) ([]string, error) {
-	f := c.getFilterData(searchFilter)
+func (c *client) LoadTargetSubFilter(resultSet string, searchFilter string) ([]string, error) {
+	f := c.getFilterData(resultSet, searchFilter)
 	if f == nil {
 		return nil, fmt.Errorf("filter not found, client:%s filter:%s", c.ID, searchFilter)
 	}
@@ -295,17 +280,27 @@ func (c *client) LoadTargetSubFilter(searchFilter string) ([]string, error) {
 	return param.ResFilters, nil
 }
 
-func (c *client) getFilterData(id string) *filterData {
-	return c.filters[id]
+func (c *client) getFilterData(resultSet string, id string) *filterData {
+	return c.getResultSet(resultSet, false)[id]
 }
 
-func (c *client) filterLogger(file string, line string) {
-	if len(line) == 0 {
+func (c *client) filterLogger(record *clientRecord) {
+	if len(record.Text) == 0 {
 		return
 	}
 
-	for _, filter := range c.filters {
-		param := &ScriptParam{Type: "log", ReqLogFile: file, ReqLogStr: line}
+	for _, filter := range c.getResultSet(record.ResultSet, true) {
+		param := &ScriptParam{
+			Type:         "log",
+			ReqLogFile:   record.File,
+			ReqLogStr:    record.Text,
+			ReqLogHost:   record.Host,
+			ReqLogPath:   record.Path,
+			ReqLogOffset: record.Offset,
+			ReqLogInode:  record.Inode,
+			ReqLogTime:   record.Time,
+			ReqLogSeq:    record.Seq,
+		}
 		filter.EntryFunc(param)
 	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lsg2020/goco"
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+var (
+	errEnrollDenied   = errors.New("enroll token not allowed for the agent")
+	errEnrollNotFound = errors.New("no files configured for the agent")
+)
+
+// Enroll registers an agent installed on its host, it answers with the params an agent
+// started over ssh gets on its stdin. host is the address the agent reached the
+// manager with, the agent connects back to it. secure tells the agent came over tls and
+// clientName is the common name of its client certificate.
+func (mgr *manager) Enroll(ctx context.Context, req *define.EnrollRequest, host string, secure bool, clientName string) (*define.AgentParams, error) {
+	var params *define.AgentParams
+	err := mgr.co.RunSync(ctx, func(ctx context.Context) error {
+		if !mgr.config.EnrollAllowed(req.Name, req.Token) {
+			return errEnrollDenied
+		}
+		if err := checkClientCert(mgr.config, req.Name, clientName); err != nil {
+			mgr.logger.Log(logger.LogLevelError, "manager enroll client certificate failed, %v", err)
+			return errEnrollDenied
+		}
+		a := mgr.agents[define.PullAgentKey(req.Name)]
+		if a == nil {
+			return errEnrollNotFound
+		}
+
+		sessionID := mgr.co.PrepareWait()
+		a.co.RunAsync(a.ctx, func(ctx context.Context) (err error) {
+			params, err = a.params()
+			if err != nil {
+				return err
+			}
+			params.WebSocketAddr = a.webSocketAddr(secure, host)
+			return nil
+		}, &co.RunOptions{Result: func(err error) {
+			mgr.co.Wakeup(sessionID, err)
+		}})
+		return mgr.co.Wait(ctx, sessionID)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	mgr.logger.Log(logger.LogLevelInfo, "manager agent enrolled, name:%s version:%s platform:%s files:%d", req.Name, req.Version, req.Platform, len(params.Files))
+	return params, nil
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/lsg2020/logfilter/define"
 	"github.com/lsg2020/logfilter/logger"
@@ -20,22 +22,86 @@ func (mgr *manager) handleAgentWS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid agent id", http.StatusBadRequest)
 		return
 	}
-	ids := r.Form["id"]
-	filename := r.Form["file"]
-	if len(ids) == 0 || ids[0] == "" || len(filename) == 0 || filename[0] == "" {
+	keys := r.Form["agent"]
+	if len(keys) == 0 || keys[0] == "" {
 		mgr.logger.Log(logger.LogLevelError, "websocket invalid agent id, %v", r.Form)
 		http.Error(w, "invalid agent id", http.StatusBadRequest)
 		return
 	}
 
+	auth := &agentAuth{
+		Token:       strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+		EnrollToken: r.Header.Get(define.EnrollTokenHeader),
+		ClientName:  clientName(r),
+	}
+	// a rejected agent exits on 401 without an upgrade
+	err = mgr.AuthAgent(r.Context(), keys[0], auth)
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "websocket agent rejected, key:%s %v %v", keys[0], r.RemoteAddr, err)
+		status := http.StatusInternalServerError
+		switch err {
+		case errEnrollDenied, errAgentToken, errAgentTokenExpired, errAgentTokenReplaced:
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	upgrader := websocket.Upgrader{} // use default options
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		mgr.logger.Log(logger.LogLevelError, "websocket upgrade failed, %v", err)
 		return
 	}
+	c.SetReadLimit(define.MaxAgentMessageSize)
+
+	mgr.BindAgentWS(keys[0], auth, c)
+}
+
+// clientName is the common name of the verified client certificate of a tls request.
+func clientName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+func (mgr *manager) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	reqBuf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &define.EnrollRequest{}
+	err = json.Unmarshal(reqBuf, req)
+	if err != nil || req.Name == "" {
+		http.Error(w, fmt.Sprintf("invalid enroll request, %v", err), http.StatusBadRequest)
+		return
+	}
+
+	params, err := mgr.Enroll(r.Context(), req, r.Host, r.TLS != nil, clientName(r))
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "enroll agent failed, name:%s %v %v", req.Name, r.RemoteAddr, err)
+		status := http.StatusInternalServerError
+		switch err {
+		case errEnrollDenied:
+			status = http.StatusForbidden
+		case errEnrollNotFound:
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	mgr.BindAgentWS(ids[0], filename[0], c)
+	resBuf, err := json.Marshal(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resBuf)
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "enroll agent write failed, %d %v", len(resBuf), err)
+	}
 }
 
 func (mgr *manager) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
@@ -226,3 +292,86 @@ func (mgr *manager) handleApiPutConfig(w http.ResponseWriter, r *http.Request) {
 		mgr.logger.Log(logger.LogLevelError, "api put config write failed, %v", err)
 	}
 }
+
+func (mgr *manager) handleApiStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := mgr.LoadStatus(r.Context())
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api status failed, %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resBuf, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resBuf)
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api status write failed, %d %v", len(resBuf), err)
+	}
+}
+
+func (mgr *manager) handleApiStartBackfill(w http.ResponseWriter, r *http.Request) {
+	reqBuf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &define.BackfillRequest{}
+	err = json.Unmarshal(reqBuf, req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("json data unmarshal failed, %v", err), http.StatusBadRequest)
+		return
+	}
+
+	status, err := mgr.StartBackfill(r.Context(), req)
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api start backfill failed, %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resBuf, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resBuf)
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api start backfill write failed, %d %v", len(resBuf), err)
+	}
+}
+
+func (mgr *manager) handleApiBackfills(w http.ResponseWriter, r *http.Request) {
+	jobs, err := mgr.LoadBackfills(r.Context())
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api backfills failed, %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resBuf, err := json.Marshal(jobs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(resBuf)
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api backfills write failed, %d %v", len(resBuf), err)
+	}
+}
+
+func (mgr *manager) handleApiDeleteResultSet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := mgr.DeleteResultSet(r.Context(), vars["target"], vars["name"])
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api delete result set failed, %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = w.Write([]byte("ok"))
+	if err != nil {
+		mgr.logger.Log(logger.LogLevelError, "api delete result set write failed, %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/lsg2020/logfilter/define"
+)
+
+func TestHandleAgentWSUnauthorized(t *testing.T) {
+	mgr, err := newManager("", &define.Config{AgentSecretFile: filepath.Join(t.TempDir(), "agent.secret")}, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.cancel()
+	server := httptest.NewServer(http.HandlerFunc(mgr.handleAgentWS))
+	defer server.Close()
+
+	const key = "user@host:22"
+	replaced, err := mgr.tokens.Issue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := mgr.tokens.Issue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.tokens.Verify(key, current); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		token string
+	}{
+		{"no token", key, ""},
+		{"replaced launch", key, replaced},
+		{"token of another key", "user@other:22", current},
+		{"enroll token not allowed", define.PullAgentKey("web"), current},
+	}
+	for _, tt := range tests {
+		addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/?agent=" + tt.key
+		conn, resp, err := websocket.DefaultDialer.Dial(addr, http.Header{"Authorization": []string{"Bearer " + tt.token}})
+		if err == nil {
+			_ = conn.Close()
+			t.Errorf("%s: websocket upgraded", tt.name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: response %v %v, want 401", tt.name, resp, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+	"github.com/lsg2020/logfilter/tailer"
+)
+
+const (
+	localQueueSize         = 2048
+	localBatchSize         = 1000
+	localFlushInterval     = time.Millisecond * 200
+	localHeartbeatInterval = time.Second * 3
+)
+
+type localRecord struct {
+	file    *define.AgentFile
+	line    *tailer.Line
+	dropped bool
+}
+
+// localCollector tails the files on the manager host in-process with the follower and
+// pipeline of the agents, its batches and heartbeats take the way of the ones of a remote
+// agent. The positions live in memory, after a manager restart the files are tailed from
+// the end again.
+type localCollector struct {
+	logger  logger.Log
+	a       *agent
+	info    *define.AgentInfo
+	records chan *localRecord
+	entries *tailer.Entries
+
+	mu        sync.Mutex
+	dropped   map[string]uint64
+	rotations []*define.AgentRotation
+}
+
+func newLocalCollector(a *agent) *localCollector {
+	hostname, err := os.Hostname()
+	if err != nil {
+		a.logger.Log(logger.LogLevelError, "local collector get hostname failed, %v", err)
+	}
+	lc := &localCollector{
+		logger: a.logger,
+		a:      a,
+		info: &define.AgentInfo{
+			Host:     hostname,
+			Pid:      os.Getpid(),
+			Session:  fmt.Sprintf("%x-%x", time.Now().UnixNano(), os.Getpid()),
+			Version:  define.Version,
+			Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		},
+		records: make(chan *localRecord, localQueueSize),
+		dropped: make(map[string]uint64),
+	}
+	lc.entries = tailer.NewEntries(tailer.EntriesConfig{
+		Name:     "local collector",
+		Logger:   a.logger,
+		Emit:     lc.emit,
+		OnRotate: lc.rotated,
+	}, nil)
+	return lc
+}
+
+// Update starts the new file entries and stops the removed ones, a changed entry is
+// restarted from the position it has reached.
+func (lc *localCollector) Update(ctx context.Context, files []*define.AgentFile) {
+	lc.entries.Update(ctx, files)
+}
+
+func (lc *localCollector) emit(ctx context.Context, file *define.AgentFile, line *tailer.Line, dropped bool) bool {
+	// the records wait for the batcher, a full client queue holds the batcher back
+	select {
+	case lc.records <- &localRecord{file: file, line: line, dropped: dropped}:
+	case <-ctx.Done():
+		return false
+	}
+	if dropped {
+		lc.mu.Lock()
+		lc.dropped[file.Key()]++
+		lc.mu.Unlock()
+	}
+	return true
+}
+
+func (lc *localCollector) rotated(r *define.AgentRotation) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.rotations = append(lc.rotations, r)
+}
+
+// Run hands the records to the agent in batches and sends heartbeats until ctx is done.
+func (lc *localCollector) Run(ctx context.Context) {
+	flushTicker := time.NewTicker(localFlushInterval)
+	defer flushTicker.Stop()
+	heartbeatTicker := time.NewTicker(localHeartbeatInterval)
+	defer heartbeatTicker.Stop()
+
+	var seq, recordSeq uint64
+	var records []*define.AgentRecord
+	dropped := make(map[string]uint64)
+	// a batch the agent failed to hand on goes again before the next one, with its
+	// sequence the targets that got it already are skipped
+	var pending *define.AgentMessage
+	flush := func() {
+		if pending != nil {
+			if err := lc.a.handleBatch(ctx, pending, 0, 0); err != nil {
+				lc.logger.Log(logger.LogLevelWarning, "local collector handle batch failed, seq:%d records:%d %v", pending.Seq, len(pending.Records), err)
+				return
+			}
+			pending = nil
+		}
+
+		lc.mu.Lock()
+		rotations := lc.rotations
+		lc.rotations = nil
+		lc.mu.Unlock()
+		if len(records) == 0 && len(dropped) == 0 && len(rotations) == 0 {
+			return
+		}
+
+		seq++
+		msg := &define.AgentMessage{
+			Version:   define.AgentProtocolVersion,
+			Type:      define.AgentMessageBatch,
+			Session:   lc.info.Session,
+			Seq:       seq,
+			Records:   records,
+			Dropped:   dropped,
+			Rotations: rotations,
+		}
+		records = nil
+		dropped = make(map[string]uint64)
+		if err := lc.a.handleBatch(ctx, msg, 0, 0); err != nil {
+			lc.logger.Log(logger.LogLevelWarning, "local collector handle batch failed, seq:%d records:%d %v", msg.Seq, len(msg.Records), err)
+			pending = msg
+		}
+	}
+
+	for {
+		select {
+		case r := <-lc.records:
+			if r.dropped {
+				dropped[r.file.Key()]++
+				break
+			}
+			recordSeq++
+			records = append(records, &define.AgentRecord{
+				Target: r.file.Target,
+				Name:   r.file.Name,
+				Path:   r.line.Path,
+				Text:   r.line.Text,
+				Offset: r.line.Offset,
+				Inode:  r.line.Pos.Inode,
+				Time:   r.line.Time.UnixNano(),
+				Seq:    recordSeq,
+			})
+			if len(records) >= localBatchSize {
+				flush()
+			}
+		case <-flushTicker.C:
+			flush()
+		case <-heartbeatTicker.C:
+			lc.heartbeat(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (lc *localCollector) heartbeat(ctx context.Context) {
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	hb := &define.AgentHeartbeat{
+		Version:    define.Version,
+		HeapBytes:  mem.HeapAlloc,
+		SysBytes:   mem.Sys,
+		Goroutines: runtime.NumGoroutine(),
+		Queued:     len(lc.records),
+		Files:      lc.States(),
+	}
+	_ = lc.a.co.RunSync(ctx, func(ctx context.Context) error {
+		lc.a.state.OnHeartbeat(hb, time.Now())
+		return nil
+	}, nil)
+}
+
+// States reports the read positions and line counts of the running entries.
+func (lc *localCollector) States() []*define.AgentFileState {
+	return lc.entries.States(func(key string) uint64 {
+		lc.mu.Lock()
+		defer lc.mu.Unlock()
+		return lc.dropped[key]
+	})
+}
+
+// startLocal runs the collector of the local files in place of a remote agent.
+func (a *agent) startLocal(ctx context.Context) error {
+	a.local = newLocalCollector(a)
+	a.state.Agent = a.local.info
+	a.connTime = time.Now()
+	a.local.Update(a.ctx, a.files)
+	go a.local.Run(a.ctx)
+	return nil
+}
+
+// isLocal reports whether the agent is the manager itself tailing its local files.
+func (a *agent) isLocal() bool {
+	return a.Key == define.LocalAgentKey
+}
+
+// connected reports whether the agent is there to tail its files, the local one always is.
+func (a *agent) connected() bool {
+	return a.conn != nil || a.local != nil
+}
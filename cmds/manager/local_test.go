@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+const testFilterScript = `package script
+
+import "logfilter"
+
+var lines []string
+
+func Entry(param *logfilter.ScriptParam) {
+	switch param.Type {
+	case "log":
+		lines = append(lines, param.ReqLogFile+" "+param.ReqLogStr)
+	case "filters":
+		param.ResFilters = append(param.ResFilters, "all")
+	case "records":
+		param.ResRecordsLogs = append(param.ResRecordsLogs, lines...)
+	}
+}
+`
+
+// TestLocalCollector feeds the lines of a local file through the agent and the client
+// queue into a filter script and reads them back the way grafana does.
+func TestLocalCollector(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte("ERROR before start\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &define.Config{
+		AgentSecretFile: filepath.Join(dir, "agent.secret"),
+		Targets: []*define.ConfigTarget{{
+			ID:      "t",
+			Open:    true,
+			Filters: []string{"f"},
+			Files:   []*define.ConfigLogFileInfo{{Name: "app", Path: path, Local: true}},
+		}},
+		Filters: []*define.ConfigFilterInfo{{
+			ID:        "f",
+			Script:    testFilterScript,
+			EntryFunc: "script.Entry",
+			Prefilter: &define.ConfigPrefilter{Levels: []string{"error"}},
+		}},
+	}
+	mgr, err := newManager("", config, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mgr.cancel()
+
+	// the files of the local collector are read from their end
+	time.Sleep(time.Millisecond * 300)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("ERROR a\nINFO b\nERROR c\n")
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"app ERROR a", "app ERROR c"}
+	var logs []string
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		var rows [][]string
+		err := mgr.co.RunSync(context.Background(), func(ctx context.Context) (err error) {
+			rows, err = mgr.LoadTargetRecords(ctx, "t", "f", "all")
+			return
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = logs[:0]
+		for _, row := range rows {
+			logs = append(logs, row[4])
+		}
+		if len(logs) >= len(want) {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if !reflect.DeepEqual(logs, want) {
+		t.Errorf("records %q, want %q", logs, want)
+	}
+}
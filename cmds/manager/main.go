@@ -53,7 +53,29 @@ func main() {
 	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	router.HandleFunc("/agentws", mgr.handleAgentWS)
+	// with agent tls the agents only connect to the tls listener
+	if config.AgentTLS == nil {
+		router.HandleFunc("/agentws", mgr.handleAgentWS)
+		router.HandleFunc("/enroll", mgr.handleEnroll).Methods("POST")
+	} else {
+		tlsConfig, reloader, err := newTLSConfig(config.AgentTLS, false, l)
+		if err != nil {
+			l.Log(logger.LogLevelError, "load agent tls failed, %v", err)
+			return
+		}
+		go reloader.Watch()
+		agentRouter := mux.NewRouter()
+		agentRouter.HandleFunc("/agentws", mgr.handleAgentWS)
+		agentRouter.HandleFunc("/enroll", mgr.handleEnroll).Methods("POST")
+		agentServer := http.Server{Handler: agentRouter, Addr: fmt.Sprintf("%s:%d", config.Address, config.AgentTLS.Port), TLSConfig: tlsConfig}
+		go func() {
+			err := agentServer.ListenAndServeTLS("", "")
+			if err != nil {
+				log.Fatalln("agent https start failed", err)
+			}
+		}()
+	}
+
 	router.HandleFunc("/query", mgr.handleGrafanaQuery).Methods("POST", "GET")
 	router.HandleFunc("/search", mgr.handleGrafanaSearch).Methods("POST", "GET")
 	router.HandleFunc("/variable", mgr.handleGrafanaSearchVariable).Methods("POST", "GET")
@@ -63,6 +85,10 @@ func main() {
 	subRouter.HandleFunc("/api/reload", mgr.handleApiReload).Methods("GET")
 	subRouter.HandleFunc("/api/config", mgr.handleApiGetConfig).Methods("GET")
 	subRouter.HandleFunc("/api/config", mgr.handleApiPutConfig).Methods("PUT")
+	subRouter.HandleFunc("/api/status", mgr.handleApiStatus).Methods("GET")
+	subRouter.HandleFunc("/api/backfill", mgr.handleApiStartBackfill).Methods("POST")
+	subRouter.HandleFunc("/api/backfill", mgr.handleApiBackfills).Methods("GET")
+	subRouter.HandleFunc("/api/result_set/{target}/{name}", mgr.handleApiDeleteResultSet).Methods("DELETE")
 
 	// view
 	staticFS, err := fs.Sub(staticFileSystem, "static")
@@ -78,8 +104,32 @@ func main() {
 
 	// start http serve
 	server := http.Server{Handler: router, Addr: fmt.Sprintf("%s:%d", config.Address, config.Port)}
-	err = server.ListenAndServe()
+	if config.TLS == nil {
+		err = server.ListenAndServe()
+		if err != nil {
+			log.Fatalln("http start failed", err)
+		}
+		return
+	}
+
+	tlsConfig, reloader, err := newTLSConfig(config.TLS, true, l)
+	if err != nil {
+		l.Log(logger.LogLevelError, "load tls failed, %v", err)
+		return
+	}
+	go reloader.Watch()
+	if config.HTTPRedirectPort != 0 {
+		redirect := http.Server{Handler: redirectHTTPS(config.Port), Addr: fmt.Sprintf("%s:%d", config.Address, config.HTTPRedirectPort)}
+		go func() {
+			err := redirect.ListenAndServe()
+			if err != nil {
+				log.Fatalln("http redirect start failed", err)
+			}
+		}()
+	}
+	server.TLSConfig = tlsConfig
+	err = server.ListenAndServeTLS("", "")
 	if err != nil {
-		log.Fatalln("http start failed", err)
+		log.Fatalln("https start failed", err)
 	}
 }
@@ -18,8 +18,14 @@ func newManager(configStr string, config *define.Config, logger logger.Log) (*ma
 		config:    config,
 		logger:    logger,
 		clients:   make(map[string]*client),
+		agents:    make(map[string]*agent),
 	}
-	err := mgr.init()
+	tokens, err := loadAgentTokens(config.AgentSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	mgr.tokens = tokens
+	err = mgr.init()
 	if err != nil {
 		return nil, err
 	}
@@ -38,6 +44,8 @@ type manager struct {
 	cancel context.CancelFunc
 
 	clients map[string]*client
+	agents  map[string]*agent
+	tokens  *agentTokens
 }
 
 func (mgr *manager) init() error {
@@ -100,6 +108,10 @@ func (mgr *manager) build(ctx context.Context, config *define.Config, configStr
 		}
 	}
 
+	if err := mgr.buildAgents(ctx, config); err != nil {
+		return err
+	}
+
 	mgr.config = config
 	mgr.configStr = configStr
 	return nil
@@ -147,6 +159,10 @@ func (mgr *manager) newClient(ctx context.Context, cfgTarget *define.ConfigTarge
 		return nil, fmt.Errorf("create client coroutine failed, %w", err)
 	}
 
+	queueSize := cfgTarget.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultClientQueueSize
+	}
 	cCtx, cCancel := context.WithCancel(ex.GetCtx())
 	c := &client{
 		ID:     cfgTarget.ID,
@@ -156,10 +172,9 @@ func (mgr *manager) newClient(ctx context.Context, cfgTarget *define.ConfigTarge
 		ctx:    cCtx,
 		cancel: cCancel,
 		mgr:    mgr,
-
-		fileConns:   make(map[string]*websocket.Conn),
-		fileCancels: make(map[string]context.CancelFunc),
+		queue:  make(chan []*clientRecord, queueSize),
 	}
+	go c.worker()
 	sessionID := mgr.co.PrepareWait()
 	c.Start(func(err error) { mgr.co.Wakeup(sessionID, err) })
 	err = mgr.co.Wait(ctx, sessionID)
@@ -169,8 +184,167 @@ func (mgr *manager) newClient(ctx context.Context, cfgTarget *define.ConfigTarge
 	return c, err
 }
 
-func (mgr *manager) BindAgentWS(id string, file string, c *websocket.Conn) {
-	mgr.logger.Log(logger.LogLevelDebug, "manager websocket start bind, %v %v %v", id, file, c.RemoteAddr().String())
+// buildAgents groups the files of the open targets by their ssh login, every login
+// runs a single agent for all of its files.
+func (mgr *manager) buildAgents(ctx context.Context, config *define.Config) error {
+	agentFiles := make(map[string][]*define.AgentFile)
+	agentSsh := make(map[string]*define.ConfigLogFileInfo)
+	agentClients := make(map[string]map[string]*client)
+	agentCompression := make(map[string]string)
+	// the logins of the closed targets too, their agents keep the binary and state
+	configured := make(map[string]bool)
+	for _, target := range config.Targets {
+		for _, file := range target.Files {
+			configured[file.AgentKey()] = true
+		}
+		if !target.Open {
+			continue
+		}
+		prefilters := targetPrefilters(config, target)
+		for _, file := range target.Files {
+			key := file.AgentKey()
+			if target.Compression == define.CompressionGzip {
+				agentCompression[key] = define.CompressionGzip
+			}
+			if agentSsh[key] == nil {
+				ssh := *file
+				ssh.JumpHosts = config.FileJumpHosts(target, file)
+				agentSsh[key] = &ssh
+				agentClients[key] = make(map[string]*client)
+			}
+			// an agent shared with other files tunnels when any of them asks for it
+			agentSsh[key].AgentTunnel = agentSsh[key].AgentTunnel || file.AgentTunnel
+			agentFiles[key] = append(agentFiles[key], &define.AgentFile{
+				Target:    target.ID,
+				Name:      file.Name,
+				Path:      file.Path,
+				Multiline: file.Multiline,
+
+				Prefilters: prefilters,
+				Overflow:   target.Overflow,
+
+				MaxRecordSize: file.MaxRecordSize,
+				Encoding:      file.Encoding,
+				InvalidUTF8:   file.InvalidUTF8,
+				Timestamp:     file.Timestamp,
+			})
+			agentClients[key][target.ID] = mgr.getClient(target.ID)
+		}
+	}
+
+	for key, files := range agentFiles {
+		a := mgr.agents[key]
+		created := a == nil
+		if created {
+			mgr.logger.Log(logger.LogLevelDebug, "manager start create agent key:%s", key)
+			var err error
+			a, err = mgr.newAgent(key, config)
+			if err != nil {
+				return fmt.Errorf("create agent failed key:%s, %w", key, err)
+			}
+		}
+
+		sessionID := mgr.co.PrepareWait()
+		a.Reload(config, agentSsh[key], files, agentCompression[key], agentClients[key], func(err error) {
+			mgr.co.Wakeup(sessionID, err)
+		})
+		if err := mgr.co.Wait(ctx, sessionID); err != nil {
+			mgr.logger.Log(logger.LogLevelError, "manager reload agent failed key:%s, %v", key, err)
+		}
+
+		if created {
+			sessionID := mgr.co.PrepareWait()
+			a.Start(func(err error) { mgr.co.Wakeup(sessionID, err) })
+			if err := mgr.co.Wait(ctx, sessionID); err != nil {
+				a.Close()
+				return fmt.Errorf("start agent failed key:%s, %w", key, err)
+			}
+			mgr.agents[key] = a
+		}
+	}
+	for key, a := range mgr.agents {
+		if agentFiles[key] == nil {
+			mgr.logger.Log(logger.LogLevelDebug, "manager free agent key:%s removed:%v", key, !configured[key])
+			a.Shutdown(!configured[key])
+			delete(mgr.agents, key)
+		}
+	}
+	return nil
+}
+
+// targetPrefilters collects the prefilters of the filters of a target, a line wanted by any
+// filter is shipped so a filter without prefilter turns them off.
+func targetPrefilters(config *define.Config, target *define.ConfigTarget) []*define.ConfigPrefilter {
+	var prefilters []*define.ConfigPrefilter
+	for _, filterID := range target.Filters {
+		filter := config.GetFilter(filterID)
+		if filter == nil || filter.Prefilter == nil {
+			return nil
+		}
+		prefilters = append(prefilters, filter.Prefilter)
+	}
+	return prefilters
+}
+
+func (mgr *manager) newAgent(key string, config *define.Config) (*agent, error) {
+	ex, err := co.NewExecuter(context.Background(), &co.ExOptions{Name: "agent"})
+	if err != nil {
+		return nil, fmt.Errorf("create agent executer failed, %w", err)
+	}
+	coroutine, err := co.New(&co.Options{Name: "agent", DebugInfo: key, Executer: ex, OnTaskRecover: func(co *co.Coroutine, t co.Task, err error) {
+		mgr.logger.Log(logger.LogLevelError, "agent task recover %v\n%v", err, string(debug.Stack()))
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("create agent coroutine failed, %w", err)
+	}
+
+	aCtx, aCancel := context.WithCancel(ex.GetCtx())
+	a := &agent{
+		Key:    key,
+		config: config,
+		logger: mgr.logger,
+		co:     coroutine,
+		ctx:    aCtx,
+		cancel: aCancel,
+		mgr:    mgr,
+		state: &agentState{
+			Records:  make(map[string]uint64),
+			Dropped:  make(map[string]uint64),
+			Overflow: make(map[string]uint64),
+			sessions: make(map[string]uint64),
+
+			Rotations: make(map[string]uint64),
+			progress:  make(map[string]*fileProgress),
+		},
+		jobs: make(map[string]*backfillJob),
+	}
+	return a, nil
+}
+
+// AuthAgent checks what an agent connects with before its websocket is upgraded.
+func (mgr *manager) AuthAgent(ctx context.Context, key string, auth *agentAuth) error {
+	return mgr.co.RunSync(ctx, func(ctx context.Context) error {
+		return mgr.authAgent(key, auth)
+	}, nil)
+}
+
+// authAgent checks the enroll token and client certificate of an enrolled agent and the
+// token of the launch of every agent.
+func (mgr *manager) authAgent(key string, auth *agentAuth) error {
+	if name := define.PullAgentName(key); name != "" {
+		if !mgr.config.EnrollAllowed(name, auth.EnrollToken) {
+			return errEnrollDenied
+		}
+		if err := checkClientCert(mgr.config, name, auth.ClientName); err != nil {
+			mgr.logger.Log(logger.LogLevelError, "manager agent client certificate failed, %v", err)
+			return errEnrollDenied
+		}
+	}
+	return mgr.tokens.Verify(key, auth.Token)
+}
+
+func (mgr *manager) BindAgentWS(key string, auth *agentAuth, c *websocket.Conn) {
+	mgr.logger.Log(logger.LogLevelDebug, "manager websocket start bind, %v %v", key, c.RemoteAddr().String())
 
 	err := mgr.co.RunAsync(mgr.ctx, func(ctx context.Context) (err error) {
 		defer func() {
@@ -179,18 +353,26 @@ func (mgr *manager) BindAgentWS(id string, file string, c *websocket.Conn) {
 			}
 		}()
 
-		client := mgr.getClient(id)
-		if client == nil {
-			err = fmt.Errorf("client not found")
+		// the agents of an older launch of their key and the ones with an expired token are
+		// told to exit, they are mostly turned away before the upgrade already
+		if err = mgr.authAgent(key, auth); err != nil {
+			_ = writeManagerMessage(c, &define.ManagerMessage{Type: define.ManagerMessageShutdown, Reason: err.Error()})
+			return
+		}
+		a := mgr.agents[key]
+		if a == nil || a.isLocal() {
+			// an agent left behind by a removed host should not reconnect again
+			_ = writeManagerMessage(c, &define.ManagerMessage{Type: define.ManagerMessageShutdown, Reason: "agent not found"})
+			err = fmt.Errorf("agent not found")
 			return
 		}
 
 		sessionID := mgr.co.PrepareWait()
-		client.BindAgentWS(c, file, func(err error) { mgr.co.Wakeup(sessionID, err) })
+		a.BindAgentWS(c, auth.Token, func(err error) { mgr.co.Wakeup(sessionID, err) })
 		err = mgr.co.Wait(ctx, sessionID)
 		return
 	}, nil)
-	mgr.logger.Log(logger.LogLevelDebug, "websocket finish bind, %v %v %v %v", id, file, c.RemoteAddr().String(), err)
+	mgr.logger.Log(logger.LogLevelDebug, "websocket finish bind, %v %v %v", key, c.RemoteAddr().String(), err)
 }
 
 func (mgr *manager) LoadVariable(ctx context.Context, t string, target string, filter string) ([]string, error) {
@@ -208,7 +390,7 @@ func (mgr *manager) LoadVariable(ctx context.Context, t string, target string, f
 	return names, err
 }
 
-func (mgr *manager) loadVariableTarget(_ context.Context) ([]string, error) {
+func (mgr *manager) loadVariableTarget(ctx context.Context) ([]string, error) {
 	clients := make([]*client, 0, len(mgr.clients))
 	for _, c := range mgr.clients {
 		clients = append(clients, c)
@@ -222,10 +404,29 @@ func (mgr *manager) loadVariableTarget(_ context.Context) ([]string, error) {
 			res = append(res, c.ID)
 		}
 	}
+
+	// the backfill result sets follow the targets, the closed targets keep theirs
+	for _, c := range clients {
+		var names []string
+		sessionID := mgr.co.PrepareWait()
+		c.co.RunAsync(c.ctx, func(ctx context.Context) error {
+			names = c.ResultSets()
+			return nil
+		}, &co.RunOptions{Result: func(err error) {
+			mgr.co.Wakeup(sessionID, err)
+		}})
+		if err := mgr.co.Wait(ctx, sessionID); err != nil {
+			return nil, fmt.Errorf("load target result sets failed, client:%s %w", c.ID, err)
+		}
+		for _, name := range names {
+			res = append(res, c.ID+define.ResultSetSeparator+name)
+		}
+	}
 	return res, nil
 }
 
 func (mgr *manager) loadVariableFilter(ctx context.Context, searchTarget string) ([]string, error) {
+	searchTarget, resultSet := splitResultSet(searchTarget)
 	c := mgr.getClient(searchTarget)
 	if c == nil {
 		return nil, fmt.Errorf("target not found: %s", searchTarget)
@@ -234,7 +435,7 @@ func (mgr *manager) loadVariableFilter(ctx context.Context, searchTarget string)
 	var res []string
 	sessionID := mgr.co.PrepareWait()
 	c.co.RunAsync(c.ctx, func(ctx context.Context) (err error) {
-		res, err = c.LoadFilters()
+		res, err = c.LoadFilters(resultSet)
 		return
 	}, &co.RunOptions{Result: func(err error) {
 		mgr.co.Wakeup(sessionID, err)
@@ -247,6 +448,7 @@ func (mgr *manager) loadVariableFilter(ctx context.Context, searchTarget string)
 }
 
 func (mgr *manager) loadVariableSubFilter(ctx context.Context, searchTarget string, searchFilter string) ([]string, error) {
+	searchTarget, resultSet := splitResultSet(searchTarget)
 	c := mgr.getClient(searchTarget)
 	if c == nil {
 		return nil, fmt.Errorf("target not found: %s", searchTarget)
@@ -255,7 +457,7 @@ func (mgr *manager) loadVariableSubFilter(ctx context.Context, searchTarget stri
 	var res []string
 	sessionID := mgr.co.PrepareWait()
 	c.co.RunAsync(c.ctx, func(ctx context.Context) (err error) {
-		res, err = c.LoadTargetSubFilter(searchFilter)
+		res, err = c.LoadTargetSubFilter(resultSet, searchFilter)
 		return
 	}, &co.RunOptions{Result: func(err error) {
 		mgr.co.Wakeup(sessionID, err)
@@ -268,7 +470,7 @@ func (mgr *manager) loadVariableSubFilter(ctx context.Context, searchTarget stri
 }
 
 func (mgr *manager) LoadTargetRecords(ctx context.Context, targetID string, filterID string, subFilterID string) ([][]string, error) {
-	clientID := targetID
+	clientID, resultSet := splitResultSet(targetID)
 	client := mgr.getClient(clientID)
 	if client == nil {
 		return nil, fmt.Errorf("client not found target:%s", targetID)
@@ -277,7 +479,7 @@ func (mgr *manager) LoadTargetRecords(ctx context.Context, targetID string, filt
 	var res [][]string
 	sessionID := mgr.co.PrepareWait()
 	client.co.RunAsync(client.ctx, func(ctx context.Context) error {
-		filter := client.getFilterData(filterID)
+		filter := client.getFilterData(resultSet, filterID)
 		if filter == nil {
 			return fmt.Errorf("filter not found:%s %s", filterID, subFilterID)
 		}
@@ -289,7 +491,7 @@ func (mgr *manager) LoadTargetRecords(ctx context.Context, targetID string, filt
 			if i < len(param.ResRecordsSummary) {
 				summary = param.ResRecordsSummary[i]
 			}
-			res = append(res, []string{clientID, filterID, subFilterID, summary, param.ResRecordsLogs[i]})
+			res = append(res, []string{targetID, filterID, subFilterID, summary, param.ResRecordsLogs[i]})
 		}
 		return nil
 	}, &co.RunOptions{Result: func(err error) {
@@ -302,3 +504,43 @@ func (mgr *manager) LoadTargetRecords(ctx context.Context, targetID string, filt
 	}
 	return res, nil
 }
+
+func (mgr *manager) LoadStatus(ctx context.Context) (*define.Status, error) {
+	status := &define.Status{}
+	err := mgr.co.RunSync(ctx, func(ctx context.Context) error {
+		status.Agents = make([]*define.AgentStatus, 0, len(mgr.agents))
+		status.Clients = make([]*define.ClientStatus, 0, len(mgr.clients))
+		for _, c := range mgr.clients {
+			status.Clients = append(status.Clients, c.Status())
+		}
+		sort.Slice(status.Clients, func(i, j int) bool { return status.Clients[i].ID < status.Clients[j].ID })
+
+		keys := make([]string, 0, len(mgr.agents))
+		for key := range mgr.agents {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			a := mgr.agents[key]
+			var agentStatus *define.AgentStatus
+			sessionID := mgr.co.PrepareWait()
+			a.co.RunAsync(a.ctx, func(ctx context.Context) error {
+				agentStatus = a.Status()
+				return nil
+			}, &co.RunOptions{Result: func(err error) {
+				mgr.co.Wakeup(sessionID, err)
+			}})
+			err := mgr.co.Wait(ctx, sessionID)
+			if err != nil {
+				return fmt.Errorf("load agent status failed, agent:%s %w", key, err)
+			}
+			status.Agents = append(status.Agents, agentStatus)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shellQuote quotes a word for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// scpUpload copies a file into a remote dir with the scp sink protocol (scp -t), the
+// remote host needs nothing but sshd and scp.
+func scpUpload(client *ssh.Client, dir string, name string, mode os.FileMode, size int64, r io.Reader) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("open ssh session failed, %w", err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("scp stdin failed, %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("scp stdout failed, %w", err)
+	}
+	acks := bufio.NewReader(stdout)
+	if err := session.Start("scp -t " + shellQuote(dir)); err != nil {
+		return fmt.Errorf("start scp failed, %w", err)
+	}
+
+	err = func() error {
+		defer stdin.Close()
+		if err := scpAck(acks); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(stdin, "C%04o %d %s\n", mode.Perm(), size, path.Base(name)); err != nil {
+			return fmt.Errorf("scp write header failed, %w", err)
+		}
+		if err := scpAck(acks); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(stdin, r, size); err != nil {
+			return fmt.Errorf("scp write file failed, %w", err)
+		}
+		if _, err := stdin.Write([]byte{0}); err != nil {
+			return fmt.Errorf("scp write file failed, %w", err)
+		}
+		return scpAck(acks)
+	}()
+	if err != nil {
+		_ = session.Wait()
+		return err
+	}
+	if err := session.Wait(); err != nil {
+		return fmt.Errorf("scp failed, %w", err)
+	}
+	return nil
+}
+
+// scpAck reads the reply of the remote scp, 0 is ok and 1 or 2 come with a message.
+func scpAck(r *bufio.Reader) error {
+	code, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("scp read reply failed, %w", err)
+	}
+	if code == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return fmt.Errorf("scp error %d, %s", code, strings.TrimSpace(msg))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultKnownHostsFile = "known_hosts"
+	defaultSshDialTimeout = time.Second * 10
+)
+
+// knownHosts checks the host keys against the known hosts file, the agents dial in
+// parallel so the keys learned on first use are added one at a time.
+type knownHosts struct {
+	mu sync.Mutex
+}
+
+var hostKeys = &knownHosts{}
+
+// Check verifies the key of a host, with tofu the key of an unknown host is added.
+func (k *knownHosts) Check(file string, policy string, hostname string, remote net.Addr, key ssh.PublicKey, l logger.Log) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// knownhosts needs the file to exist
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open known hosts failed, %w", err)
+	}
+	_ = f.Close()
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return fmt.Errorf("load known hosts failed, %w", err)
+	}
+
+	err = callback(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if err == nil || !errors.As(err, &keyErr) {
+		return err
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	if len(keyErr.Want) > 0 {
+		known := make([]string, 0, len(keyErr.Want))
+		for _, want := range keyErr.Want {
+			known = append(known, fmt.Sprintf("%s %s:%d", ssh.FingerprintSHA256(want.Key), want.Filename, want.Line))
+		}
+		l.Log(logger.LogLevelError, "ssh host key changed, possible man in the middle, host:%s key:%s known:%s", hostname, fingerprint, strings.Join(known, ","))
+		return fmt.Errorf("host key verification failed, %s presents %s %s but %s knows %s", hostname, key.Type(), fingerprint, file, strings.Join(known, ","))
+	}
+	if policy != define.HostKeyTOFU {
+		return fmt.Errorf("host key verification failed, %s presents %s %s not in %s", hostname, key.Type(), fingerprint, file)
+	}
+
+	f, err = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open known hosts failed, %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"); err != nil {
+		return fmt.Errorf("write known hosts failed, %w", err)
+	}
+	l.Log(logger.LogLevelInfo, "ssh host key trusted on first use, host:%s key:%s %s", hostname, key.Type(), fingerprint)
+	return nil
+}
+
+// sshEndpoint is one host of the ssh chain to a log host.
+type sshEndpoint struct {
+	Name    string
+	Host    string
+	Port    int
+	User    string
+	Pwd     string
+	Key     string
+	HostKey string
+}
+
+func (e *sshEndpoint) Addr() string {
+	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+}
+
+// clientConfig verifies the host key by ssh_host_key or the host key policy, seen gets the
+// fingerprint of the key.
+func (e *sshEndpoint) clientConfig(cfg *define.Config, l logger.Log, seen func(fingerprint string)) (*ssh.ClientConfig, error) {
+	var auth ssh.AuthMethod
+	if e.Pwd != "" {
+		auth = ssh.Password(e.Pwd)
+	} else {
+		signer, err := ssh.ParsePrivateKey([]byte(e.Key))
+		if err != nil {
+			return nil, fmt.Errorf("parse ssh key of %s failed, %w", e.Name, err)
+		}
+		auth = ssh.PublicKeys(signer)
+	}
+
+	knownHostsFile := cfg.KnownHostsFile
+	if knownHostsFile == "" {
+		knownHostsFile = defaultKnownHostsFile
+	}
+	policy := cfg.HostKeyPolicy
+	if policy == "" {
+		policy = define.HostKeyTOFU
+	}
+
+	return &ssh.ClientConfig{
+		User:    e.User,
+		Auth:    []ssh.AuthMethod{auth},
+		Timeout: defaultSshDialTimeout,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fingerprint := ssh.FingerprintSHA256(key)
+			if seen != nil {
+				seen(fingerprint)
+			}
+			switch {
+			case e.HostKey != "":
+				if fingerprint != e.HostKey {
+					l.Log(logger.LogLevelError, "ssh host key mismatch, possible man in the middle, host:%s key:%s ssh_host_key:%s", hostname, fingerprint, e.HostKey)
+					return fmt.Errorf("host key verification failed, %s presents %s %s but ssh_host_key is %s", hostname, key.Type(), fingerprint, e.HostKey)
+				}
+				return nil
+			case policy == define.HostKeyInsecure:
+				return nil
+			}
+			return hostKeys.Check(knownHostsFile, policy, hostname, remote, key, l)
+		},
+	}, nil
+}
+
+// sshConn is the ssh connection to a log host, through its jump hosts when it has some.
+type sshConn struct {
+	client *ssh.Client
+	hops   []*ssh.Client
+}
+
+// Client is the ssh client of the log host.
+func (c *sshConn) Client() *ssh.Client {
+	return c.client
+}
+
+// Output runs a command and returns its standard output.
+func (c *sshConn) Output(cmd string) ([]byte, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("open ssh session failed, %w", err)
+	}
+	defer session.Close()
+	return session.Output(cmd)
+}
+
+// Run runs a command until it exits.
+func (c *sshConn) Run(cmd string, stdout io.Writer, stderr io.Writer) error {
+	return c.RunInput(cmd, nil, stdout, stderr)
+}
+
+// RunInput runs a command fed with stdin until it exits.
+func (c *sshConn) RunInput(cmd string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("open ssh session failed, %w", err)
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(cmd)
+}
+
+func (c *sshConn) Close() error {
+	var err error
+	if c.client != nil {
+		err = c.client.Close()
+	}
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		_ = c.hops[i].Close()
+	}
+	return err
+}
+
+// dialSSH opens the ssh connection of a file entry through its jump hosts and verifies
+// every host key. It returns the fingerprint of the host key of the log host.
+func dialSSH(cfg *define.Config, file *define.ConfigLogFileInfo, l logger.Log) (*sshConn, string, error) {
+	endpoints := make([]*sshEndpoint, 0, len(file.JumpHosts)+1)
+	for _, id := range file.JumpHosts {
+		b := cfg.GetBastion(id)
+		if b == nil {
+			return nil, "", fmt.Errorf("jump host %s not found", id)
+		}
+		endpoints = append(endpoints, &sshEndpoint{Name: "jump host " + id, Host: b.SshHost, Port: b.SshPort, User: b.SshUser, Pwd: b.SshPwd, Key: b.SshKey, HostKey: b.SshHostKey})
+	}
+	endpoints = append(endpoints, &sshEndpoint{Name: file.AgentKey(), Host: file.SshHost, Port: file.SshPort, User: file.SshUser, Pwd: file.SshPwd, Key: file.SshKey, HostKey: file.SshHostKey})
+
+	var fingerprint string
+	conn := &sshConn{}
+	for i, e := range endpoints {
+		var seen func(string)
+		if i == len(endpoints)-1 {
+			seen = func(f string) { fingerprint = f }
+		}
+		clientConfig, err := e.clientConfig(cfg, l, seen)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fingerprint, err
+		}
+
+		var client *ssh.Client
+		if conn.client == nil {
+			client, err = ssh.Dial("tcp", e.Addr(), clientConfig)
+		} else {
+			client, err = dialThrough(conn.client, e.Addr(), clientConfig)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, fingerprint, fmt.Errorf("ssh dial %s failed, %w", e.Name, err)
+		}
+		if conn.client != nil {
+			conn.hops = append(conn.hops, conn.client)
+		}
+		conn.client = client
+	}
+	return conn, fingerprint, nil
+}
+
+// dialThrough opens a ssh connection over a tcp forward of a jump host.
+func dialThrough(jump *ssh.Client, addr string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	netConn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("forward to %s failed, %w", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, clientConfig)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
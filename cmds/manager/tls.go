@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	defaultCertReloadInterval = time.Second * 10
+)
+
+// certReloader serves the certificate and client ca of a tls listener and loads them again
+// when their files change, a broken file is logged and the loaded ones are kept.
+type certReloader struct {
+	cfg    *define.ConfigTLS
+	auth   tls.ClientAuthType
+	logger logger.Log
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	clients *x509.CertPool
+	stamps  map[string]time.Time
+}
+
+// newTLSConfig is the tls config of a listener. With a client ca the manager listener
+// requires client certificates, the agent one only verifies them when given since the
+// agents started over ssh have none.
+func newTLSConfig(cfg *define.ConfigTLS, requireClientCert bool, l logger.Log) (*tls.Config, *certReloader, error) {
+	r := &certReloader{cfg: cfg, logger: l, auth: tls.NoClientCert}
+	if cfg.ClientCAFile != "" {
+		r.auth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			r.auth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if err := r.load(); err != nil {
+		return nil, nil, err
+	}
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.cert, nil
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.clients
+		c.ClientAuth = r.auth
+		return c, nil
+	}
+	return base, r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+func (r *certReloader) load() error {
+	stamps := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("stat tls file failed, %w", err)
+		}
+		stamps[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	var clients *x509.CertPool
+	if err != nil {
+		err = fmt.Errorf("load tls certificate failed, %w", err)
+	} else if r.cfg.ClientCAFile != "" {
+		clients, err = loadCertPool(r.cfg.ClientCAFile)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// broken files are not tried again until they change
+	r.stamps = stamps
+	if err != nil {
+		return err
+	}
+	r.cert, r.clients = &cert, clients
+	return nil
+}
+
+// changed reports whether a file changed since the last load.
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.stamps[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch polls the files and reloads the certificates when they change.
+func (r *certReloader) Watch() {
+	for range time.Tick(defaultCertReloadInterval) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			r.logger.Log(logger.LogLevelError, "reload tls certificate failed, keep the loaded one, %v", err)
+			continue
+		}
+		r.logger.Log(logger.LogLevelInfo, "reload tls certificate %s", r.cfg.CertFile)
+	}
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read ca failed, %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificate in ca %s", file)
+	}
+	return pool, nil
+}
+
+// redirectHTTPS sends the plain http requests to the https listener on port.
+func redirectHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		http.Redirect(w, r, fmt.Sprintf("https://%s%s", net.JoinHostPort(host, fmt.Sprint(port)), r.URL.RequestURI()), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+const (
+	defaultAgentSecretFile = "agent_secret"
+	agentSecretSize        = 32
+	// a token is signed again for the connected agent after agentTokenRefresh, the one not
+	// signed within agentTokenMaxAge is expired
+	agentTokenRefresh = time.Hour
+	agentTokenMaxAge  = time.Hour * 24
+)
+
+var (
+	errAgentToken         = errors.New("invalid agent token")
+	errAgentTokenExpired  = errors.New("agent token expired")
+	errAgentTokenReplaced = errors.New("agent token replaced by a newer launch")
+)
+
+// agentTokens signs the token every launched or enrolled agent connects with. A token
+// is bound to the agent key and carries a nonce of its launch, the secret is kept in a
+// file so the running agents still connect after a manager restart. The launch of a key
+// that connected last is current, a newer launch replaces it once it connects and the
+// older ones are rejected from then on.
+type agentTokens struct {
+	secret []byte
+
+	mu      sync.Mutex
+	current map[string]*agentLaunch
+}
+
+// agentLaunch is the current launch of an agent key.
+type agentLaunch struct {
+	nonce  string
+	launch int64
+	signed time.Time
+}
+
+func loadAgentTokens(file string) (*agentTokens, error) {
+	if file == "" {
+		file = defaultAgentSecretFile
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read agent secret failed, %w", err)
+	}
+	if err == nil {
+		secret, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(secret) < agentSecretSize {
+			return nil, fmt.Errorf("agent secret %s invalid, need %d hex encoded bytes", file, agentSecretSize)
+		}
+		return &agentTokens{secret: secret, current: make(map[string]*agentLaunch)}, nil
+	}
+
+	secret := make([]byte, agentSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate agent secret failed, %w", err)
+	}
+	if err := ioutil.WriteFile(file, []byte(hex.EncodeToString(secret)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("write agent secret failed, %w", err)
+	}
+	return &agentTokens{secret: secret, current: make(map[string]*agentLaunch)}, nil
+}
+
+// Issue signs the token of a new launch of an agent, like
+// <nonce>.<launch unix nano>.<signed unix>.<hmac>. The current launch of key is still
+// accepted until the new one connects.
+func (t *agentTokens) Issue(key string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate agent token failed, %w", err)
+	}
+	l := &agentLaunch{nonce: hex.EncodeToString(buf), launch: time.Now().UnixNano(), signed: time.Now()}
+	return t.token(key, l), nil
+}
+
+// Refresh signs the token an agent connected with again once it is older than
+// agentTokenRefresh, empty when it needs no new one or its launch is replaced.
+func (t *agentTokens) Refresh(key string, token string) string {
+	l, err := t.parse(key, token)
+	if err != nil || time.Since(l.signed) < agentTokenRefresh {
+		return ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cur := t.current[key]; cur == nil || cur.launch != l.launch || cur.nonce != l.nonce {
+		return ""
+	}
+	l.signed = time.Now()
+	return t.token(key, l)
+}
+
+// Verify checks that a token was issued to the current or a newer launch of the agent of
+// key and is not expired, a newer launch becomes the current one.
+func (t *agentTokens) Verify(key string, token string) error {
+	l, err := t.parse(key, token)
+	if err != nil {
+		return err
+	}
+	if time.Since(l.signed) > agentTokenMaxAge {
+		return errAgentTokenExpired
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cur := t.current[key]
+	if cur == nil || l.launch > cur.launch {
+		// the launches issued before a manager restart are known by their tokens only
+		t.current[key] = l
+		return nil
+	}
+	if l.launch != cur.launch || subtle.ConstantTimeCompare([]byte(l.nonce), []byte(cur.nonce)) != 1 {
+		return errAgentTokenReplaced
+	}
+	return nil
+}
+
+// parse checks the signature of a token and returns the launch it was issued to.
+func (t *agentTokens) parse(key string, token string) (*agentLaunch, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return nil, errAgentToken
+	}
+	payload, mac := token[:i], token[i+1:]
+	if subtle.ConstantTimeCompare([]byte(t.sign(key, payload)), []byte(mac)) != 1 {
+		return nil, errAgentToken
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return nil, errAgentToken
+	}
+	launch, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errAgentToken
+	}
+	signed, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errAgentToken
+	}
+	return &agentLaunch{nonce: parts[0], launch: launch, signed: time.Unix(signed, 0)}, nil
+}
+
+func (t *agentTokens) token(key string, l *agentLaunch) string {
+	payload := fmt.Sprintf("%s.%d.%d", l.nonce, l.launch, l.signed.Unix())
+	return payload + "." + t.sign(key, payload)
+}
+
+func (t *agentTokens) sign(key string, payload string) string {
+	h := hmac.New(sha256.New, t.secret)
+	_, _ = h.Write([]byte(key + "\n" + payload))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// agentAuth is what an agent connection presents, the signed token, the enroll token of
+// an enrolled agent and the common name of its verified client certificate.
+type agentAuth struct {
+	Token       string
+	EnrollToken string
+	ClientName  string
+}
+
+// checkClientCert requires the enrolled agents to present a client certificate of their
+// name when mutual tls is on.
+func checkClientCert(config *define.Config, name string, clientName string) error {
+	tlsCfg := config.AgentListenerTLS()
+	if name == "" || tlsCfg == nil || tlsCfg.ClientCAFile == "" {
+		return nil
+	}
+	if clientName != name {
+		return fmt.Errorf("agent %s needs a client certificate of its name, got %q", name, clientName)
+	}
+	return nil
+}
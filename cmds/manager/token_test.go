@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testTokens() *agentTokens {
+	return &agentTokens{secret: make([]byte, agentSecretSize), current: make(map[string]*agentLaunch)}
+}
+
+func TestAgentTokensVerify(t *testing.T) {
+	const key = "user@host:22"
+	tokens := testTokens()
+	launch := func(ago time.Duration, signed time.Duration) string {
+		now := time.Now()
+		return tokens.token(key, &agentLaunch{nonce: "n", launch: now.Add(-ago).UnixNano(), signed: now.Add(-signed)})
+	}
+	first, err := tokens.Issue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tokens.Issue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		token string
+		err   error
+	}{
+		{"first connect", key, first, nil},
+		{"issued launch does not replace", key, first, nil},
+		{"newer launch connects", key, second, nil},
+		{"replaced launch", key, first, errAgentTokenReplaced},
+		{"older launch", key, launch(time.Hour, 0), errAgentTokenReplaced},
+		{"other key", "user@other:22", second, errAgentToken},
+		{"tampered", key, second[:len(second)-1] + "0", errAgentToken},
+		{"malformed", key, "token", errAgentToken},
+		{"expired", key, launch(-time.Hour, agentTokenMaxAge+time.Minute), errAgentTokenExpired},
+		{"current still accepted", key, second, nil},
+	}
+	for _, tt := range tests {
+		if err := tokens.Verify(tt.key, tt.token); !errors.Is(err, tt.err) {
+			t.Errorf("%s: verify %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestAgentTokensRestart(t *testing.T) {
+	const key = "pull:web"
+	tokens := testTokens()
+	token, err := tokens.Issue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a manager restarted with the same secret knows the launch by its token only
+	restarted := testTokens()
+	if err := restarted.Verify(key, token); err != nil {
+		t.Errorf("token of a launch before the restart rejected, %v", err)
+	}
+}
+
+func TestAgentTokensRefresh(t *testing.T) {
+	const key = "user@host:22"
+	tokens := testTokens()
+	now := time.Now()
+	old := tokens.token(key, &agentLaunch{nonce: "a", launch: now.UnixNano(), signed: now.Add(-agentTokenRefresh - time.Minute)})
+	fresh, err := tokens.Issue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		connect   bool
+		refreshed bool
+	}{
+		{"not connected", old, false, false},
+		{"old", old, true, true},
+		{"fresh", fresh, true, false},
+		{"replaced", old, false, false},
+	}
+	for _, tt := range tests {
+		if tt.connect {
+			if err := tokens.Verify(key, tt.token); err != nil {
+				t.Fatalf("%s: verify %v", tt.name, err)
+			}
+		}
+		refreshed := tokens.Refresh(key, tt.token)
+		if (refreshed != "") != tt.refreshed {
+			t.Errorf("%s: refreshed %q, want %v", tt.name, refreshed, tt.refreshed)
+			continue
+		}
+		if refreshed == "" {
+			continue
+		}
+		if err := tokens.Verify(key, refreshed); err != nil {
+			t.Errorf("%s: refreshed token rejected, %v", tt.name, err)
+		}
+		if l, err := tokens.parse(key, refreshed); err != nil || time.Since(l.signed) > time.Minute {
+			t.Errorf("%s: refreshed token %+v %v", tt.name, l, err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// serveTunnel forwards a port on the loopback of the log host to the agent websocket of the
+// manager over the ssh connection, the agent connects to the manager through it.
+func (a *agent) serveTunnel(conn *sshConn) (net.Listener, error) {
+	ln, err := conn.Client().Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("open reverse tunnel failed, %w", err)
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/agentws", a.mgr.handleAgentWS)
+	go func() {
+		_ = http.Serve(ln, router)
+	}()
+	return ln, nil
+}
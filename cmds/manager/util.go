@@ -5,9 +5,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/tailer"
 	"github.com/traefik/yaegi/interp"
 	"github.com/traefik/yaegi/stdlib"
 )
@@ -18,6 +23,15 @@ type ScriptParam struct {
 	// log
 	ReqLogFile string
 	ReqLogStr  string
+	// agent host name, file path, byte offset and inode of the file where the line starts
+	ReqLogHost   string
+	ReqLogPath   string
+	ReqLogOffset int64
+	ReqLogInode  uint64
+	// time the agent read the line
+	ReqLogTime time.Time
+	// sequence of the line, it increases with every line of an agent
+	ReqLogSeq uint64
 
 	// filters
 	ResFilters []string
@@ -83,22 +97,106 @@ func LoadConfig() (string, *define.Config, error) {
 	return string(buf), c, nil
 }
 
+// names of the enrolled agents
+var agentNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
 func CheckConfig(c *define.Config) error {
 	// check filter
 	logTargets := make(map[string]bool)
+	agents := make(map[string]*define.ConfigLogFileInfo)
+	agentJumpHosts := make(map[string]string)
+	bastions := make(map[string]bool)
+	for _, b := range c.Bastions {
+		if b.ID == "" || bastions[b.ID] {
+			return fmt.Errorf("bastion:%s empty or repeat", b.ID)
+		}
+		bastions[b.ID] = true
+		if b.SshHost == "" || b.SshPort == 0 || (b.SshKey == "" && b.SshPwd == "") || b.SshUser == "" {
+			return fmt.Errorf("bastion:%s need ssh info", b.ID)
+		}
+		if b.SshHostKey != "" && !strings.HasPrefix(b.SshHostKey, "SHA256:") {
+			return fmt.Errorf("bastion:%s ssh host key need a SHA256 fingerprint", b.ID)
+		}
+	}
 	for _, target := range c.Targets {
 		if logTargets[target.ID] {
 			return fmt.Errorf("log file:%s repeat", target.ID)
 		}
 		logTargets[target.ID] = true
 
+		if err := define.CheckCompression(target.Compression); err != nil {
+			return fmt.Errorf("log file:%s %w", target.ID, err)
+		}
+		if target.Overflow != nil {
+			if err := target.Overflow.Check(); err != nil {
+				return fmt.Errorf("log file:%s %w", target.ID, err)
+			}
+		}
+
+		names := make(map[string]bool)
 		for _, f := range target.Files {
 			if f.Path == "" {
 				return fmt.Errorf("log file:%s need path", target.ID)
 			}
-			if f.SshHost == "" || f.SshPort == 0 || (f.SshKey == "" && f.SshPwd == "") || f.SshUser == "" {
+			if f.Local {
+				if f.Agent != "" || f.SshHost != "" || len(f.JumpHosts) > 0 || f.AgentTunnel || f.AgentDir != "" {
+					return fmt.Errorf("log file:%s %s local file takes no agent or ssh info", target.ID, f.Name)
+				}
+			} else if f.Agent != "" {
+				if !agentNameRegexp.MatchString(f.Agent) {
+					return fmt.Errorf("log file:%s %s invalid agent name %s", target.ID, f.Name, f.Agent)
+				}
+				if f.SshHost != "" || len(f.JumpHosts) > 0 || f.AgentTunnel {
+					return fmt.Errorf("log file:%s %s enrolled agent takes no ssh info", target.ID, f.Name)
+				}
+			} else if f.SshHost == "" || f.SshPort == 0 || (f.SshKey == "" && f.SshPwd == "") || f.SshUser == "" {
 				return fmt.Errorf("log file:%s need ssh info", target.ID)
 			}
+			if names[f.Name] {
+				return fmt.Errorf("log file:%s %s repeat", target.ID, f.Name)
+			}
+			names[f.Name] = true
+			// the files of a ssh login share one agent and so its credentials
+			if other := agents[f.AgentKey()]; other != nil && (other.SshPwd != f.SshPwd || other.SshKey != f.SshKey) {
+				return fmt.Errorf("log file:%s %s ssh credentials differ from other files of %s", target.ID, f.Name, f.AgentKey())
+			}
+			// the dir is quoted for the remote shell, a relative one is already in the login dir
+			if strings.HasPrefix(f.AgentDir, "~") {
+				return fmt.Errorf("log file:%s %s agent dir %s is not expanded, use a path relative to the login dir", target.ID, f.Name, f.AgentDir)
+			}
+			if other := agents[f.AgentKey()]; other != nil && other.AgentDir != f.AgentDir {
+				return fmt.Errorf("log file:%s %s agent dir differs from other files of %s", target.ID, f.Name, f.AgentKey())
+			}
+			if other := agents[f.AgentKey()]; other != nil && other.SshHostKey != f.SshHostKey {
+				return fmt.Errorf("log file:%s %s ssh host key differs from other files of %s", target.ID, f.Name, f.AgentKey())
+			}
+			if f.SshHostKey != "" && !strings.HasPrefix(f.SshHostKey, "SHA256:") {
+				return fmt.Errorf("log file:%s %s ssh host key need a SHA256 fingerprint", target.ID, f.Name)
+			}
+			jumpHosts := c.FileJumpHosts(target, f)
+			if other := agents[f.AgentKey()]; other != nil && agentJumpHosts[f.AgentKey()] != strings.Join(jumpHosts, ",") {
+				return fmt.Errorf("log file:%s %s jump hosts differ from other files of %s", target.ID, f.Name, f.AgentKey())
+			}
+			agentJumpHosts[f.AgentKey()] = strings.Join(jumpHosts, ",")
+			for _, id := range jumpHosts {
+				if c.GetBastion(id) == nil {
+					return fmt.Errorf("log file:%s %s not exists jump host:%s", target.ID, f.Name, id)
+				}
+			}
+			agents[f.AgentKey()] = f
+			if _, err := tailer.NewTranscoder(&define.AgentFile{Encoding: f.Encoding, InvalidUTF8: f.InvalidUTF8}); err != nil {
+				return fmt.Errorf("log file:%s %s encoding error, %w", target.ID, f.Name, err)
+			}
+			if f.Multiline != nil {
+				if _, err := tailer.NewMultiline(f.Multiline); err != nil {
+					return fmt.Errorf("log file:%s %s multiline error, %w", target.ID, f.Name, err)
+				}
+			}
+			if f.Timestamp != nil {
+				if err := f.Timestamp.Check(); err != nil {
+					return fmt.Errorf("log file:%s %s timestamp error, %w", target.ID, f.Name, err)
+				}
+			}
 		}
 		for _, filterID := range target.Filters {
 			if c.GetFilter(filterID) == nil {
@@ -107,8 +205,61 @@ func CheckConfig(c *define.Config) error {
 		}
 	}
 
+	if t := c.AgentTLS; t != nil {
+		if t.Port == 0 || t.Port == c.Port {
+			return fmt.Errorf("agent tls need a port of its own")
+		}
+		if t.CertFile == "" || t.KeyFile == "" {
+			return fmt.Errorf("agent tls need cert_file and key_file")
+		}
+	}
+	if t := c.TLS; t != nil {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return fmt.Errorf("tls need cert_file and key_file")
+		}
+		// the agents started over ssh have no client certificate
+		if t.ClientCAFile != "" && c.AgentTLS == nil {
+			return fmt.Errorf("tls with client_ca_file need agent_tls for the agents")
+		}
+	}
+	if c.HTTPRedirectPort != 0 && (c.TLS == nil || c.HTTPRedirectPort == c.Port) {
+		return fmt.Errorf("http redirect port need tls and a port of its own")
+	}
+	if err := define.CheckHostKeyPolicy(c.HostKeyPolicy); err != nil {
+		return err
+	}
+	for _, t := range c.EnrollTokens {
+		if t.Token == "" {
+			return fmt.Errorf("enroll token empty")
+		}
+	}
+	if c.AgentBinaryDir != "" {
+		info, err := os.Stat(c.AgentBinaryDir)
+		if err != nil {
+			return fmt.Errorf("agent binary dir error, %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("agent binary dir %s is not a directory", c.AgentBinaryDir)
+		}
+	}
+	if canary := c.AgentCanary; canary != nil {
+		if canary.Binary == "" {
+			return fmt.Errorf("agent canary need binary")
+		}
+		for _, target := range canary.Targets {
+			if !logTargets[target] {
+				return fmt.Errorf("agent canary not exists target:%s", target)
+			}
+		}
+	}
+
 	// check script
 	for _, filter := range c.Filters {
+		if filter.Prefilter != nil {
+			if _, err := tailer.NewPrefilter([]*define.ConfigPrefilter{filter.Prefilter}); err != nil {
+				return fmt.Errorf("filter:%s prefilter error, %w", filter.ID, err)
+			}
+		}
 		_, err := LoadScript(filter.Script)
 		if filter.Script == "" || err != nil {
 			return fmt.Errorf("filter:%s base script error, %w", filter.ID, err)
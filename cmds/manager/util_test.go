@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+func TestCheckConfig(t *testing.T) {
+	testConfig := func() *define.Config {
+		return &define.Config{
+			Targets: []*define.ConfigTarget{{
+				ID:      "t",
+				Filters: []string{"f"},
+				Files: []*define.ConfigLogFileInfo{
+					{Name: "app", Path: "/log/app.log", SshHost: "host", SshPort: 22, SshUser: "user", SshPwd: "pwd"},
+				},
+			}},
+			Filters: []*define.ConfigFilterInfo{{ID: "f", Script: testFilterScript, EntryFunc: "script.Entry"}},
+		}
+	}
+	file := func(c *define.Config) *define.ConfigLogFileInfo {
+		return c.Targets[0].Files[0]
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *define.Config)
+		ok     bool
+	}{
+		{"valid", func(c *define.Config) {}, true},
+		{"local file", func(c *define.Config) {
+			*file(c) = define.ConfigLogFileInfo{Name: "app", Path: "/log/app.log", Local: true}
+		}, true},
+		{"enrolled agent", func(c *define.Config) {
+			*file(c) = define.ConfigLogFileInfo{Name: "app", Path: "/log/app.log", Agent: "web-1"}
+		}, true},
+		{"relative agent dir", func(c *define.Config) { file(c).AgentDir = "bin/logfilter" }, true},
+		{"repeated target", func(c *define.Config) { c.Targets = append(c.Targets, &define.ConfigTarget{ID: "t"}) }, false},
+		{"repeated file", func(c *define.Config) { c.Targets[0].Files = append(c.Targets[0].Files, file(c)) }, false},
+		{"no path", func(c *define.Config) { file(c).Path = "" }, false},
+		{"no ssh info", func(c *define.Config) { file(c).SshPwd = "" }, false},
+		{"local file with ssh info", func(c *define.Config) { file(c).Local = true }, false},
+		{"invalid agent name", func(c *define.Config) {
+			*file(c) = define.ConfigLogFileInfo{Name: "app", Path: "/log/app.log", Agent: "web 1"}
+		}, false},
+		{"enrolled agent with ssh info", func(c *define.Config) { file(c).Agent = "web" }, false},
+		{"agent dir with ~", func(c *define.Config) { file(c).AgentDir = "~/bin" }, false},
+		{"host key without SHA256", func(c *define.Config) { file(c).SshHostKey = "MD5:aa" }, false},
+		{"unknown jump host", func(c *define.Config) { file(c).JumpHosts = []string{"bastion"} }, false},
+		{"credentials differ for a login", func(c *define.Config) {
+			other := *file(c)
+			other.Name = "other"
+			other.SshPwd = "other"
+			c.Targets[0].Files = append(c.Targets[0].Files, &other)
+		}, false},
+		{"unknown filter", func(c *define.Config) { c.Targets[0].Filters = []string{"missing"} }, false},
+		{"unknown compression", func(c *define.Config) { c.Targets[0].Compression = "zstd" }, false},
+		{"invalid multiline", func(c *define.Config) { file(c).Multiline = &define.ConfigMultiline{Start: "("} }, false},
+		{"unknown entry function", func(c *define.Config) { c.Filters[0].EntryFunc = "script.Missing" }, false},
+		{"empty enroll token", func(c *define.Config) { c.EnrollTokens = []*define.ConfigEnrollToken{{}} }, false},
+	}
+	for _, tt := range tests {
+		c := testConfig()
+		tt.modify(c)
+		if err := CheckConfig(c); (err == nil) != tt.ok {
+			t.Errorf("%s: check config %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
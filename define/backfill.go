@@ -0,0 +1,101 @@
+package define
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BackfillRequest starts a one-off job reading the existing lines of a target file,
+// every range is optional and the ranges given all have to match.
+type BackfillRequest struct {
+	Target string `json:"target"`
+	File   string `json:"file"`
+	// concrete file to read, every file matching the file path by default
+	Path string `json:"path"`
+	// byte range [from_offset, to_offset) of the line starts, 0 is open
+	FromOffset int64 `json:"from_offset"`
+	ToOffset   int64 `json:"to_offset"`
+	// line range [from_line, to_line] counted from 1, 0 is open
+	FromLine int64 `json:"from_line"`
+	ToLine   int64 `json:"to_line"`
+	// time range [since, until) of the timestamps parsed from the records
+	Since     time.Time        `json:"since"`
+	Until     time.Time        `json:"until"`
+	Timestamp *ConfigTimestamp `json:"timestamp"`
+	// also read the rotated siblings like app.log.1 and app.log.2.gz, oldest first
+	Rotated bool `json:"rotated"`
+	// records go to a separate result set of the target filters, the normal records by default
+	ResultSet string `json:"result_set"`
+}
+
+func (r *BackfillRequest) Check() error {
+	if r.FromOffset < 0 || r.ToOffset < 0 || (r.ToOffset > 0 && r.ToOffset <= r.FromOffset) {
+		return fmt.Errorf("backfill offset range [%d, %d) invalid", r.FromOffset, r.ToOffset)
+	}
+	if r.FromLine < 0 || r.ToLine < 0 || (r.ToLine > 0 && r.ToLine < r.FromLine) {
+		return fmt.Errorf("backfill line range [%d, %d] invalid", r.FromLine, r.ToLine)
+	}
+	if !r.Since.IsZero() && !r.Until.IsZero() && !r.Until.After(r.Since) {
+		return fmt.Errorf("backfill time range [%v, %v) invalid", r.Since, r.Until)
+	}
+	if r.Timestamp != nil {
+		if err := r.Timestamp.Check(); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(r.ResultSet, ResultSetSeparator) {
+		return fmt.Errorf("backfill result set %s can not contain %s", r.ResultSet, ResultSetSeparator)
+	}
+	return nil
+}
+
+// TimeRange reports whether the job selects records by their timestamp.
+func (r *BackfillRequest) TimeRange() bool {
+	return !r.Since.IsZero() || !r.Until.IsZero()
+}
+
+// ResultSetSeparator joins a target and a result set into the target name used by the
+// grafana queries, like nginx#incident
+const ResultSetSeparator = "#"
+
+// BackfillJob is a backfill request sent to the agent of its file.
+type BackfillJob struct {
+	ID   string     `json:"id"`
+	File *AgentFile `json:"file"`
+	BackfillRequest
+}
+
+// backfill job states
+const (
+	BackfillRunning = "running"
+	BackfillDone    = "done"
+	BackfillFailed  = "failed"
+)
+
+// AgentJobStatus is sent by the agent after the last record of a backfill job.
+type AgentJobStatus struct {
+	ID    string `json:"id"`
+	Files int    `json:"files"`
+	// records shipped and records dropped by the prefilters
+	Lines    uint64 `json:"lines"`
+	Filtered uint64 `json:"filtered"`
+	Error    string `json:"error,omitempty"`
+}
+
+// BackfillStatus is a backfill job reported by the manager backfill api.
+type BackfillStatus struct {
+	ID       string           `json:"id"`
+	Agent    string           `json:"agent"`
+	Request  *BackfillRequest `json:"request"`
+	State    string           `json:"state"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished,omitempty"`
+	// records queued for the result set so far
+	Records uint64 `json:"records"`
+	// records dropped because their target was gone or closed
+	Dropped  uint64 `json:"dropped"`
+	Files    int    `json:"files"`
+	Filtered uint64 `json:"filtered"`
+	Error    string `json:"error,omitempty"`
+}
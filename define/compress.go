@@ -0,0 +1,67 @@
+package define
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// agent message compressions, a compressed message is framed by the magic of its format
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// MaxAgentMessageSize bounds an agent message on the websocket and after decompression, a
+// full batch of records of the default max record size fits in it
+const MaxAgentMessageSize = 128 << 20
+
+func CheckCompression(compression string) error {
+	switch compression {
+	case "", CompressionNone, CompressionGzip:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %s", compression)
+}
+
+// Compress encodes a message, it is returned as is without compression.
+func Compress(compression string, buf []byte) ([]byte, error) {
+	if compression != CompressionGzip {
+		return buf, nil
+	}
+
+	out := &bytes.Buffer{}
+	w := gzip.NewWriter(out)
+	if _, err := w.Write(buf); err != nil {
+		return nil, fmt.Errorf("gzip write failed, %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("gzip close failed, %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// Decompress decodes a message by its frame magic, a json message is returned as is.
+func Decompress(buf []byte) ([]byte, error) {
+	if !bytes.HasPrefix(buf, gzipMagic) {
+		return buf, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("gzip reader failed, %w", err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, MaxAgentMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip read failed, %w", err)
+	}
+	if len(out) > MaxAgentMessageSize {
+		return nil, fmt.Errorf("gzip message larger than %d bytes", MaxAgentMessageSize)
+	}
+	return out, nil
+}
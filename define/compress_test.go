@@ -0,0 +1,71 @@
+package define
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	msg := []byte(`{"type":"batch","records":[{"text":"hello"}]}`)
+	tests := []struct {
+		compression string
+		framed      bool
+	}{
+		{"", false},
+		{CompressionNone, false},
+		{CompressionGzip, true},
+	}
+	for _, tt := range tests {
+		buf, err := Compress(tt.compression, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if framed := bytes.HasPrefix(buf, gzipMagic); framed != tt.framed {
+			t.Errorf("compression %q framed %v, want %v", tt.compression, framed, tt.framed)
+		}
+		out, err := Decompress(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, msg) {
+			t.Errorf("compression %q round trip %q", tt.compression, out)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	gz := func(size int) []byte {
+		out := &bytes.Buffer{}
+		w := gzip.NewWriter(out)
+		_, _ = w.Write(make([]byte, size))
+		_ = w.Close()
+		return out.Bytes()
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		ok   bool
+	}{
+		{"at limit", gz(MaxAgentMessageSize), true},
+		{"beyond limit", gz(MaxAgentMessageSize + 1), false},
+		{"corrupt", append(append([]byte{}, gzipMagic...), 0, 1, 2), false},
+	}
+	for _, tt := range tests {
+		out, err := Decompress(tt.buf)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s decompressed %d bytes, %v", tt.name, len(out), err)
+		}
+	}
+}
+
+func TestCheckCompression(t *testing.T) {
+	for _, c := range []string{"", CompressionNone, CompressionGzip} {
+		if err := CheckCompression(c); err != nil {
+			t.Errorf("compression %q rejected, %v", c, err)
+		}
+	}
+	if err := CheckCompression("zstd"); err == nil {
+		t.Error("unknown compression accepted")
+	}
+}
@@ -1,10 +1,72 @@
 package define
 
+import (
+	"crypto/subtle"
+	"fmt"
+	"regexp"
+)
+
 type ConfigTarget struct {
 	ID      string               `json:"id"`
 	Open    bool                 `json:"open"`
 	Filters []string             `json:"filters"`
 	Files   []*ConfigLogFileInfo `json:"files"`
+	// compression of the batches sent by the agents of the target, none or gzip. an agent
+	// shared with other targets compresses when any of them asks for it
+	Compression string `json:"compression"`
+	// overflow policy of the agent queue when the manager can not keep up
+	Overflow *ConfigOverflow `json:"overflow"`
+	// batches waiting for the filters of the target in manager, it applies when the target is created
+	QueueSize int `json:"queue_size"`
+	// bastions dialed in order to reach the hosts of the files without their own jump hosts
+	JumpHosts []string `json:"jump_hosts"`
+}
+
+// agent queue overflow policies
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+	OverflowSample     = "sample"
+)
+
+// ssh host key policies
+const (
+	// only the keys in the known hosts file are accepted
+	HostKeyStrict = "strict"
+	// the key of an unknown host is added to the known hosts file on the first connection,
+	// a changed key is refused
+	HostKeyTOFU = "tofu"
+	// the host keys are not checked
+	HostKeyInsecure = "insecure"
+)
+
+func CheckHostKeyPolicy(policy string) error {
+	switch policy {
+	case "", HostKeyStrict, HostKeyTOFU, HostKeyInsecure:
+		return nil
+	}
+	return fmt.Errorf("unknown host key policy %s", policy)
+}
+
+type ConfigOverflow struct {
+	// block, drop-oldest, drop-newest or sample, block by default
+	Policy string `json:"policy"`
+	// sample keeps one of every sample_rate lines while the queue is over half full
+	SampleRate int `json:"sample_rate"`
+}
+
+func (o *ConfigOverflow) Check() error {
+	switch o.Policy {
+	case "", OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	case OverflowSample:
+		if o.SampleRate < 0 {
+			return fmt.Errorf("overflow sample rate %d invalid", o.SampleRate)
+		}
+	default:
+		return fmt.Errorf("unknown overflow policy %s", o.Policy)
+	}
+	return nil
 }
 
 type ConfigLogFileInfo struct {
@@ -15,13 +77,94 @@ type ConfigLogFileInfo struct {
 	SshUser string `json:"ssh_user"`
 	SshPwd  string `json:"ssh_pwd"`
 	SshKey  string `json:"ssh_key"`
+	// SshHostKey pins the SHA256 fingerprint of the host key, like SHA256:nThbg6kX...
+	SshHostKey string `json:"ssh_host_key"`
+	// JumpHosts are the bastions dialed in order to reach the host, the agent connects back
+	// through a reverse tunnel of the ssh connection
+	JumpHosts []string `json:"jump_hosts"`
+	// AgentTunnel connects the agent to the manager through a reverse tunnel of the ssh
+	// connection, the host does not need to reach the manager address
+	AgentTunnel bool `json:"agent_tunnel"`
+	// AgentDir is the remote dir the agent binary is uploaded to over ssh, a relative one is
+	// inside the login dir which is the default. A leading ~ is not expanded and rejected
+	AgentDir string `json:"agent_dir"`
+	// Agent names an agent installed on its host that enrolls itself, the file needs no
+	// ssh info then
+	Agent string `json:"agent"`
+	// Local tails the file on the manager host in-process, the file needs no ssh info then
+	Local bool `json:"local"`
+
+	SpoolMaxSize int64            `json:"spool_max_size"`
+	Multiline    *ConfigMultiline `json:"multiline"`
+	// records longer than max_record_size bytes are truncated with a marker, 64KB by default
+	MaxRecordSize int `json:"max_record_size"`
+	// encoding of the file like gbk or gb18030, utf-8 by default
+	Encoding string `json:"encoding"`
+	// replace or escape the bytes that are not valid utf-8, replace by default
+	InvalidUTF8 string `json:"invalid_utf8"`
+	// timestamp of the records, used by the backfill time ranges
+	Timestamp *ConfigTimestamp `json:"timestamp"`
+}
+
+const (
+	InvalidUTF8Replace = "replace"
+	InvalidUTF8Escape  = "escape"
+)
+
+// AgentKey identifies the remote agent of a file, the files sharing a ssh login are
+// tailed by one agent.
+func (f *ConfigLogFileInfo) AgentKey() string {
+	if f.Agent != "" {
+		return PullAgentKey(f.Agent)
+	}
+	if f.Local {
+		return LocalAgentKey
+	}
+	return fmt.Sprintf("%s@%s:%d", f.SshUser, f.SshHost, f.SshPort)
+}
+
+// ConfigMultiline joins the physical lines of one event, like a stack trace, into one record
+type ConfigMultiline struct {
+	// regexp matching the first line of an event
+	Start string `json:"start"`
+	// regexp matching the following lines of an event
+	Continuation      string `json:"continuation"`
+	MaxLines          int    `json:"max_lines"`
+	FlushMilliseconds int    `json:"flush_milliseconds"`
+}
+
+// ConfigTimestamp parses the time of a record, the first submatch of the pattern, or the
+// whole match without one, is parsed with the go time layout in the agent time zone.
+type ConfigTimestamp struct {
+	Pattern string `json:"pattern"`
+	Layout  string `json:"layout"`
+}
+
+func (t *ConfigTimestamp) Check() error {
+	if t.Pattern == "" || t.Layout == "" {
+		return fmt.Errorf("timestamp needs both pattern and layout")
+	}
+	if _, err := regexp.Compile(t.Pattern); err != nil {
+		return fmt.Errorf("timestamp pattern %s invalid, %w", t.Pattern, err)
+	}
+	return nil
 }
 
 type ConfigFilterInfo struct {
-	ID        string `json:"id"`
-	Desc      string `json:"desc"`
-	Script    string `json:"script"`
-	EntryFunc string `json:"entry_func"`
+	ID        string           `json:"id"`
+	Desc      string           `json:"desc"`
+	Script    string           `json:"script"`
+	EntryFunc string           `json:"entry_func"`
+	Prefilter *ConfigPrefilter `json:"prefilter"`
+}
+
+// ConfigPrefilter is checked by the agents before the lines are shipped, a line is
+// kept when it matches any of the rules and dropped on the agent otherwise
+type ConfigPrefilter struct {
+	Contains []string `json:"contains"`
+	Regexps  []string `json:"regexps"`
+	// level keywords matched as whole words ignoring case, like ERROR or WARN
+	Levels []string `json:"levels"`
 }
 
 type Config struct {
@@ -32,6 +175,63 @@ type Config struct {
 	AdminPwd      string              `json:"admin_pwd"`
 	Targets       []*ConfigTarget     `json:"targets"`
 	Filters       []*ConfigFilterInfo `json:"filters"`
+	// AgentTunnel connects every agent through a reverse tunnel of its ssh connection
+	AgentTunnel bool `json:"agent_tunnel"`
+	// EnrollTokens let the agents installed on their hosts enroll themselves
+	EnrollTokens []*ConfigEnrollToken `json:"enroll_tokens"`
+	// Bastions are the jump hosts the targets reach their hosts through
+	Bastions []*ConfigBastion `json:"bastions"`
+	// AgentCanary rolls a new agent binary out to some targets first
+	AgentCanary *ConfigAgentCanary `json:"agent_canary"`
+	// KnownHostsFile holds the ssh host keys, known_hosts in the working dir by default
+	KnownHostsFile string `json:"known_hosts_file"`
+	// HostKeyPolicy is how the hosts without ssh_host_key are verified, tofu by default
+	HostKeyPolicy string `json:"host_key_policy"`
+	// AgentBinaryDir holds agent builds of each platform named like LogFilterAgent-linux-arm64,
+	// they take precedence over the builds embedded in static
+	AgentBinaryDir string `json:"agent_binary_dir"`
+	// AgentSecretFile keeps the key the agent tokens are signed with, agent_secret in the
+	// working dir by default. It is created on the first start
+	AgentSecretFile string `json:"agent_secret_file"`
+	// AgentTLS serves the agent websocket and enroll over tls on its own port, the agents
+	// then connect with wss. It applies when the manager starts
+	AgentTLS *ConfigTLS `json:"agent_tls"`
+	// TLS serves the manager over https on port, it applies when the manager starts. The
+	// certificates are reloaded when their files change
+	TLS *ConfigTLS `json:"tls"`
+	// HTTPRedirectPort redirects the plain http requests on it to https, off when 0
+	HTTPRedirectPort int `json:"http_redirect_port"`
+}
+
+// ConfigTLS is a tls listener of the manager
+type ConfigTLS struct {
+	// Port of the agent listener, the manager listener takes the port of the config
+	Port     int    `json:"port"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CAFile is the pem the agents verify the manager certificate with, the cert file itself
+	// for a self signed one. The system roots are used without it
+	CAFile string `json:"ca_file"`
+	// ClientCAFile turns on mutual tls, the enrolled agents then need a client certificate
+	// signed by it with their agent name as common name. The manager listener requires
+	// a client certificate of every client
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// AgentListenerTLS is the tls of the listener the agents connect to, nil when it is plain
+// http.
+func (c *Config) AgentListenerTLS() *ConfigTLS {
+	if c.AgentTLS != nil {
+		return c.AgentTLS
+	}
+	return c.TLS
+}
+
+// ConfigAgentCanary runs the agent binary named binary, served next to LogFilterAgent, on
+// the hosts of the listed targets. A host shared with other targets runs it as well.
+type ConfigAgentCanary struct {
+	Binary  string   `json:"binary"`
+	Targets []string `json:"targets"`
 }
 
 func (c *Config) GetTarget(id string) *ConfigTarget {
@@ -56,6 +256,66 @@ func (c *Config) GetTargetFile(id string, file string) *ConfigLogFileInfo {
 	return nil
 }
 
+// ConfigEnrollToken is a token the agents enroll with
+type ConfigEnrollToken struct {
+	Token string `json:"token"`
+	// names of the agents allowed to enroll with the token, any agent when empty
+	Agents []string `json:"agents"`
+}
+
+// EnrollAllowed reports whether the agent of a name may enroll with a token.
+func (c *Config) EnrollAllowed(name string, token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, t := range c.EnrollTokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) != 1 {
+			continue
+		}
+		if len(t.Agents) == 0 {
+			return true
+		}
+		for _, agent := range t.Agents {
+			if agent == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ConfigBastion is a jump host with its own credentials
+type ConfigBastion struct {
+	ID         string `json:"id"`
+	SshHost    string `json:"ssh_host"`
+	SshPort    int    `json:"ssh_port"`
+	SshUser    string `json:"ssh_user"`
+	SshPwd     string `json:"ssh_pwd"`
+	SshKey     string `json:"ssh_key"`
+	SshHostKey string `json:"ssh_host_key"`
+}
+
+func (c *Config) GetBastion(id string) *ConfigBastion {
+	for _, bastion := range c.Bastions {
+		if bastion.ID == id {
+			return bastion
+		}
+	}
+	return nil
+}
+
+// FileJumpHosts returns the jump hosts of a file entry, a file without its own takes the
+// ones of its target. The enrolled and local agents are not reached over ssh.
+func (c *Config) FileJumpHosts(target *ConfigTarget, f *ConfigLogFileInfo) []string {
+	if f.Agent != "" || f.Local {
+		return nil
+	}
+	if len(f.JumpHosts) > 0 {
+		return f.JumpHosts
+	}
+	return target.JumpHosts
+}
+
 func (c *Config) GetFilter(id string) *ConfigFilterInfo {
 	for _, filter := range c.Filters {
 		if filter.ID == id {
@@ -4,11 +4,53 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 type AgentParams struct {
-	WebSocketAddr string `json:"web_socket_addr"`
-	LogPath       string `json:"log_path"`
+	WebSocketAddr string       `json:"web_socket_addr"`
+	StateDir      string       `json:"state_dir"`
+	SpoolMaxSize  int64        `json:"spool_max_size"`
+	Files         []*AgentFile `json:"files"`
+	Compression   string       `json:"compression"`
+	// Token is signed by the manager for this launch of the agent, the agent connects with it
+	Token string `json:"token"`
+	// CACert is the pem the agent verifies a wss manager with, the system roots without it
+	CACert string `json:"ca_cert,omitempty"`
+	// ExitWithSession stops the agent when the stdin of the ssh session that started it is
+	// closed, a tunneled agent can't reach the manager without its session
+	ExitWithSession bool `json:"exit_with_session,omitempty"`
+}
+
+// LocalAgentKey is the agent of the local files tailed by the manager itself
+const LocalAgentKey = "local"
+
+// pull agents are keyed by their name
+const pullAgentPrefix = "pull:"
+
+func PullAgentKey(name string) string {
+	return pullAgentPrefix + name
+}
+
+// PullAgentName returns the name of a pull agent key, empty for the agents started over ssh.
+func PullAgentName(key string) string {
+	if strings.HasPrefix(key, pullAgentPrefix) {
+		return key[len(pullAgentPrefix):]
+	}
+	return ""
+}
+
+// EnrollTokenHeader carries the enroll token of an enrolled agent on its websocket, the
+// token stays out of the url the agent and proxies log
+const EnrollTokenHeader = "X-Enroll-Token"
+
+// EnrollRequest registers an agent installed on its host, the manager answers with the
+// params of the agent.
+type EnrollRequest struct {
+	Name     string `json:"name"`
+	Token    string `json:"token"`
+	Version  string `json:"version"`
+	Platform string `json:"platform"`
 }
 
 func (ap *AgentParams) ToString() (string, error) {
@@ -0,0 +1,156 @@
+package define
+
+// AgentProtocolVersion is bumped on every incompatible change of the agent websocket messages
+const AgentProtocolVersion = 12
+
+// agent -> manager message types
+const (
+	AgentMessageHello     = "hello"
+	AgentMessageBatch     = "batch"
+	AgentMessageHeartbeat = "heartbeat"
+)
+
+// manager -> agent message types
+const (
+	ManagerMessageAck    = "ack"
+	ManagerMessageConfig = "config"
+	// starts a backfill job
+	ManagerMessageBackfill = "backfill"
+	// asks the agent to exit, it is started again with the binary the manager serves
+	ManagerMessageUpgrade = "upgrade"
+	// asks the agent to exit for good, its host is removed from config
+	ManagerMessageShutdown = "shutdown"
+	// a new signature of the token the agent connects with, the old one expires
+	ManagerMessageToken = "token"
+)
+
+type AgentInfo struct {
+	Host    string `json:"host"`
+	Pid     int    `json:"pid"`
+	Session string `json:"session"`
+	// build version, sha256 checksum and GOOS/GOARCH of the agent binary
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+	Platform string `json:"platform"`
+}
+
+// AgentFile is one configured log file entry tailed by an agent
+type AgentFile struct {
+	Target    string           `json:"target"`
+	Name      string           `json:"name"`
+	Path      string           `json:"path"`
+	Multiline *ConfigMultiline `json:"multiline,omitempty"`
+	// the prefilters of the target filters, nil ships every line
+	Prefilters []*ConfigPrefilter `json:"prefilters,omitempty"`
+	Overflow   *ConfigOverflow    `json:"overflow,omitempty"`
+
+	MaxRecordSize int    `json:"max_record_size,omitempty"`
+	Encoding      string `json:"encoding,omitempty"`
+	InvalidUTF8   string `json:"invalid_utf8,omitempty"`
+
+	Timestamp *ConfigTimestamp `json:"timestamp,omitempty"`
+}
+
+func (f *AgentFile) Key() string {
+	return AgentFileKey(f.Target, f.Name)
+}
+
+// AgentFileKey identifies a file entry among the files of an agent.
+func AgentFileKey(target string, name string) string {
+	return target + "/" + name
+}
+
+// AgentMessage is the envelope of every agent message, a batch is identified by
+// the agent session that read it and its sequence inside that session.
+type AgentMessage struct {
+	Version int            `json:"version"`
+	Type    string         `json:"type"`
+	Agent   *AgentInfo     `json:"agent,omitempty"`
+	Session string         `json:"session,omitempty"`
+	Seq     uint64         `json:"seq,omitempty"`
+	Records []*AgentRecord `json:"records,omitempty"`
+	// lines dropped by the prefilters of each file entry since the previous batch
+	Dropped map[string]uint64 `json:"dropped,omitempty"`
+	// lines lost to the overflow policy or a full spool of each file entry
+	Overflow map[string]uint64 `json:"overflow,omitempty"`
+	// backfill jobs finished with the records before them
+	Jobs []*AgentJobStatus `json:"jobs,omitempty"`
+	// rotations of the tailed files since the previous batch
+	Rotations []*AgentRotation `json:"rotations,omitempty"`
+	Heartbeat *AgentHeartbeat  `json:"heartbeat,omitempty"`
+}
+
+// AgentHeartbeat is sent by the agent every few seconds whether it has lines or not.
+type AgentHeartbeat struct {
+	Version    string `json:"version"`
+	HeapBytes  uint64 `json:"heap_bytes"`
+	SysBytes   uint64 `json:"sys_bytes"`
+	Goroutines int    `json:"goroutines"`
+	// queued records waiting for the sender
+	Queued int               `json:"queued"`
+	Files  []*AgentFileState `json:"files"`
+}
+
+// AgentFileState is the tail state of a file entry, Read and Dropped count the lines
+// since the agent started.
+type AgentFileState struct {
+	Target    string               `json:"target"`
+	Name      string               `json:"name"`
+	Read      uint64               `json:"read"`
+	Dropped   uint64               `json:"dropped"`
+	Positions []*AgentFilePosition `json:"positions"`
+}
+
+// AgentFilePosition is the read position of a file and its size when the heartbeat was sent.
+type AgentFilePosition struct {
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// AgentRecord is one log event of a file entry, Path is the concrete file it was read from
+type AgentRecord struct {
+	Target string `json:"target"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Text   string `json:"text"`
+	// byte offset of the event in the file and the inode of the file
+	Offset int64  `json:"offset"`
+	Inode  uint64 `json:"inode"`
+	// read time in unix nanoseconds
+	Time int64 `json:"time"`
+	// Seq increases with every record of the agent, also across restarts
+	Seq uint64 `json:"seq"`
+	// the backfill job that read the record, empty for tailed records
+	Job string `json:"job,omitempty"`
+}
+
+// AgentRotation is a rotation of a tailed file, the rest of the old file was read from
+// Source, a rotated sibling like app.log.1, before the agent moved on to the new file.
+type AgentRotation struct {
+	Target string `json:"target"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	// rename, copytruncate, truncate or restart
+	Kind     string `json:"kind"`
+	OldInode uint64 `json:"old_inode"`
+	NewInode uint64 `json:"new_inode"`
+	Source   string `json:"source,omitempty"`
+	// bytes read from the old file after the rotation was noticed
+	Drained int64 `json:"drained"`
+	// unix nanoseconds
+	Time int64 `json:"time"`
+}
+
+type ManagerMessage struct {
+	Type        string       `json:"type"`
+	Session     string       `json:"session,omitempty"`
+	Seq         uint64       `json:"seq,omitempty"`
+	Files       []*AgentFile `json:"files,omitempty"`
+	Compression string       `json:"compression,omitempty"`
+	Job         *BackfillJob `json:"job,omitempty"`
+	// why the agent is asked to upgrade or shut down
+	Reason string `json:"reason,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
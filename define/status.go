@@ -0,0 +1,89 @@
+package define
+
+import "time"
+
+// AgentStatus is the state of a remote agent reported by the manager status api
+type AgentStatus struct {
+	Key         string     `json:"key"`
+	Targets     []string   `json:"targets"`
+	Connected   bool       `json:"connected"`
+	Agent       *AgentInfo `json:"agent,omitempty"`
+	Gaps        uint64     `json:"gaps"`
+	Duplicates  uint64     `json:"duplicates"`
+	Compression string     `json:"compression"`
+	Batches     uint64     `json:"batches"`
+	// batch bytes received on the websocket and after decompression
+	WireBytes        uint64  `json:"wire_bytes"`
+	RawBytes         uint64  `json:"raw_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	// records received and lines dropped by the agent prefilters, keyed by target/file
+	Records map[string]uint64 `json:"records"`
+	Dropped map[string]uint64 `json:"dropped"`
+	// lines lost on the agent to the overflow policy or a full spool
+	Overflow map[string]uint64 `json:"overflow"`
+	// rotations of the tailed files keyed by target/file, and the latest ones
+	Rotations       map[string]uint64 `json:"rotations"`
+	RecentRotations []*AgentRotation  `json:"recent_rotations"`
+
+	// the last heartbeat of the agent and the liveness of its file entries
+	Version       string        `json:"version"`
+	LastHeartbeat time.Time     `json:"last_heartbeat"`
+	HeapBytes     uint64        `json:"heap_bytes"`
+	SysBytes      uint64        `json:"sys_bytes"`
+	Queued        int           `json:"queued"`
+	Files         []*FileStatus `json:"files"`
+	// the agent is installed on its host and enrolled itself instead of started over ssh
+	Enrolled bool `json:"enrolled"`
+	// the files are on the manager host and tailed by the manager itself
+	Local bool `json:"local"`
+	// the platform and ssh host key fingerprint of the host seen by the deployment, the agent
+	// build it should run and its checksum
+	Platform    string `json:"platform"`
+	HostKey     string `json:"host_key"`
+	Binary      string `json:"binary"`
+	Checksum    string `json:"checksum"`
+	Upgrades    uint64 `json:"upgrades"`
+	DeployError string `json:"deploy_error,omitempty"`
+	// the address on the host the agent reaches the manager through, empty without tunnel
+	Tunnel string `json:"tunnel,omitempty"`
+}
+
+// file entry liveness states
+const (
+	// lines arrive or the file has nothing new to read
+	FileConnected = "connected"
+	// nothing was read for a while and the files have nothing left to read
+	FileIdle = "idle"
+	// the files grow but the agent does not read on, or its heartbeats stopped
+	FileStalled = "stalled"
+	// the agent is not connected
+	FileDisconnected = "disconnected"
+)
+
+// FileStatus is the liveness of a file entry of an agent, Lag is the bytes written to its
+// files but not read yet.
+type FileStatus struct {
+	Target       string               `json:"target"`
+	Name         string               `json:"name"`
+	State        string               `json:"state"`
+	Read         uint64               `json:"read"`
+	Dropped      uint64               `json:"dropped"`
+	Lag          int64                `json:"lag"`
+	LastProgress time.Time            `json:"last_progress"`
+	Positions    []*AgentFilePosition `json:"positions"`
+}
+
+// ClientStatus is the filter queue of a target in manager
+type ClientStatus struct {
+	ID        string `json:"id"`
+	QueueSize int    `json:"queue_size"`
+	Queued    int    `json:"queued"`
+	Processed uint64 `json:"processed"`
+	// records dropped because the target was closed while they were queued
+	Dropped uint64 `json:"dropped"`
+}
+
+type Status struct {
+	Agents  []*AgentStatus  `json:"agents"`
+	Clients []*ClientStatus `json:"clients"`
+}
@@ -0,0 +1,5 @@
+package define
+
+// Version of the manager and agent build, set with
+// -ldflags "-X github.com/lsg2020/logfilter/define.Version=v1.2.3"
+var Version = "dev"
@@ -5,9 +5,9 @@ go 1.16
 require (
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
-	github.com/helloyi/go-sshclient v1.1.1
 	github.com/lsg2020/goco v0.0.0-20230414151858-e9a1489d99f1
-	github.com/nxadm/tail v1.4.8
 	github.com/tidwall/gjson v1.14.1
 	github.com/traefik/yaegi v0.13.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/text v0.3.7
 )
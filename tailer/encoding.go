@@ -0,0 +1,138 @@
+package tailer
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lsg2020/logfilter/define"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+const (
+	defaultMaxRecordSize = 64 * 1024
+)
+
+// Transcoder turns the raw text of a log file into valid utf-8 of a bounded size.
+type Transcoder struct {
+	decoder       *encoding.Decoder
+	escape        bool
+	maxRecordSize int
+}
+
+func NewTranscoder(cfg *define.AgentFile) (*Transcoder, error) {
+	t := &Transcoder{maxRecordSize: cfg.MaxRecordSize}
+	if t.maxRecordSize <= 0 {
+		t.maxRecordSize = defaultMaxRecordSize
+	}
+
+	switch cfg.InvalidUTF8 {
+	case "", define.InvalidUTF8Replace:
+	case define.InvalidUTF8Escape:
+		t.escape = true
+	default:
+		return nil, fmt.Errorf("unknown invalid utf8 handling %s", cfg.InvalidUTF8)
+	}
+
+	name := strings.ToLower(cfg.Encoding)
+	if name != "" && name != "utf-8" && name != "utf8" {
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown encoding %s, %w", cfg.Encoding, err)
+		}
+		t.decoder = enc.NewDecoder()
+	}
+	return t, nil
+}
+
+// MaxRecordSize is the most bytes kept of a record, the tail reader also skips the
+// bytes of a line beyond it.
+func (t *Transcoder) MaxRecordSize() int {
+	return t.maxRecordSize
+}
+
+// Decode converts a line from the file encoding before it is truncated, the bytes that
+// are still not valid utf-8 are replaced or escaped. A line the reader cut at the max
+// record size may end in the middle of a character, that rest is counted as truncated.
+func (t *Transcoder) Decode(line *Line) {
+	text := line.Text
+	if t.decoder != nil {
+		decoded, rest, err := t.decodePartial(text, line.Truncated > 0)
+		if err == nil {
+			text = decoded
+			line.Truncated += int64(rest)
+		}
+	} else if line.Truncated > 0 {
+		end := incompleteRune(text)
+		line.Truncated += int64(len(text) - end)
+		text = text[:end]
+	}
+	line.Text = t.valid(text)
+}
+
+// decodePartial decodes a line, with cut set an incomplete character at its end is left
+// out and its byte count returned.
+func (t *Transcoder) decodePartial(text string, cut bool) (string, int, error) {
+	t.decoder.Reset()
+	// a byte of the single byte encodings takes at most 3 bytes in utf-8
+	dst := make([]byte, 3*len(text)+utf8.UTFMax)
+	nDst, nSrc, err := t.decoder.Transform(dst, []byte(text), !cut)
+	if err != nil && !(cut && err == transform.ErrShortSrc) {
+		return "", 0, err
+	}
+	return string(dst[:nDst]), len(text) - nSrc, nil
+}
+
+// incompleteRune is where an utf-8 character cut off at the end of text starts, the length
+// of text when it ends with a complete one.
+func incompleteRune(text string) int {
+	for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(text[i]) {
+			if !utf8.FullRuneInString(text[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(text)
+}
+
+func (t *Transcoder) valid(text string) string {
+	if utf8.ValidString(text) {
+		return text
+	}
+	if !t.escape {
+		return strings.ToValidUTF8(text, string(utf8.RuneError))
+	}
+
+	b := &strings.Builder{}
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(b, "\\x%02x", text[0])
+		} else {
+			b.WriteString(text[:size])
+		}
+		text = text[size:]
+	}
+	return b.String()
+}
+
+// Truncate cuts a record down to the max record size at a rune boundary and marks how
+// many bytes were cut, including the ones skipped by the tail reader.
+func (t *Transcoder) Truncate(line *Line) {
+	cut := line.Truncated
+	if len(line.Text) > t.maxRecordSize {
+		end := t.maxRecordSize
+		for end > 0 && !utf8.RuneStart(line.Text[end]) {
+			end--
+		}
+		cut += int64(len(line.Text) - end)
+		line.Text = line.Text[:end]
+	}
+	if cut > 0 {
+		line.Text = fmt.Sprintf("%s...[truncated %d bytes]", line.Text, cut)
+	}
+}
@@ -0,0 +1,122 @@
+package tailer
+
+import (
+	"testing"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+func TestTranscoderDecode(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       *define.AgentFile
+		text      string
+		truncated int64
+		want      string
+		// truncated bytes after decoding
+		wantTruncated int64
+	}{
+		{
+			name: "utf8",
+			cfg:  &define.AgentFile{},
+			text: "héllo 中文",
+			want: "héllo 中文",
+		},
+		{
+			name: "invalid replaced",
+			cfg:  &define.AgentFile{},
+			text: "a\xffb",
+			want: "a�b",
+		},
+		{
+			name: "invalid escaped",
+			cfg:  &define.AgentFile{InvalidUTF8: define.InvalidUTF8Escape},
+			text: "a\xff\xfeb",
+			want: `a\xff\xfeb`,
+		},
+		{
+			name:          "utf8 cut in a character",
+			cfg:           &define.AgentFile{},
+			text:          "a中\xe6\x96",
+			truncated:     10,
+			want:          "a中",
+			wantTruncated: 12,
+		},
+		{
+			name: "gbk",
+			cfg:  &define.AgentFile{Encoding: "gbk"},
+			text: "a\xd6\xd0\xce\xc4",
+			want: "a中文",
+		},
+		{
+			name:          "gbk cut in a character",
+			cfg:           &define.AgentFile{Encoding: "GBK"},
+			text:          "a\xd6\xd0\xce",
+			truncated:     3,
+			want:          "a中",
+			wantTruncated: 4,
+		},
+		{
+			name: "latin1",
+			cfg:  &define.AgentFile{Encoding: "iso-8859-1"},
+			text: "caf\xe9",
+			want: "café",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTranscoder(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			line := &Line{Text: tt.text, Truncated: tt.truncated}
+			tc.Decode(line)
+			if line.Text != tt.want || line.Truncated != tt.wantTruncated {
+				t.Errorf("decode %q = %q truncated:%d, want %q truncated:%d", tt.text, line.Text, line.Truncated, tt.want, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestTranscoderTruncate(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		text      string
+		truncated int64
+		want      string
+	}{
+		{"short", 8, "abc", 0, "abc"},
+		{"exact", 3, "abc", 0, "abc"},
+		{"long", 3, "abcdef", 0, "abc...[truncated 3 bytes]"},
+		{"rune boundary", 4, "ab中文", 0, "ab...[truncated 6 bytes]"},
+		{"cut by reader", 8, "abc", 100, "abc...[truncated 100 bytes]"},
+		{"cut by both", 2, "abc", 100, "ab...[truncated 101 bytes]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTranscoder(&define.AgentFile{MaxRecordSize: tt.max})
+			if err != nil {
+				t.Fatal(err)
+			}
+			line := &Line{Text: tt.text, Truncated: tt.truncated}
+			tc.Truncate(line)
+			if line.Text != tt.want {
+				t.Errorf("truncate %q = %q, want %q", tt.text, line.Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTranscoderInvalid(t *testing.T) {
+	for _, cfg := range []*define.AgentFile{
+		{Encoding: "no-such-encoding"},
+		{InvalidUTF8: "drop"},
+	} {
+		if _, err := NewTranscoder(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
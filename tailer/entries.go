@@ -0,0 +1,228 @@
+package tailer
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+// EntriesConfig tells Entries where the records and rotations of the file entries go.
+type EntriesConfig struct {
+	// Name goes before the log lines of the entries
+	Name string
+	// Since is the time of the resumed positions
+	Since  time.Time
+	Logger logger.Log
+	// Emit hands a record of an entry on, the entry stops when it returns false. The
+	// position of the line moves forward once it returned true.
+	Emit func(ctx context.Context, file *define.AgentFile, line *Line, dropped bool) bool
+	// OnRotate is called for every rotation of the files of the entries
+	OnRotate func(r *define.AgentRotation)
+}
+
+type entry struct {
+	cfg    *define.AgentFile
+	cancel context.CancelFunc
+	// closed when the follower and the pipeline of the entry are gone
+	done chan struct{}
+}
+
+// Entries runs a follower and a pipeline for every file entry, the entries change with
+// the config and a changed entry goes on from the position it has reached.
+type Entries struct {
+	cfg EntriesConfig
+
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	files     map[string]*entry
+	positions map[string]map[string]Position
+	// lines read of each entry since the start
+	read map[string]uint64
+}
+
+// NewEntries returns the entries resuming from the positions keyed by entry key and path.
+func NewEntries(cfg EntriesConfig, resume map[string]map[string]Position) *Entries {
+	e := &Entries{
+		cfg:       cfg,
+		files:     make(map[string]*entry),
+		positions: make(map[string]map[string]Position),
+		read:      make(map[string]uint64),
+	}
+	for key, files := range resume {
+		for path, pos := range files {
+			e.setPosition(key, path, pos)
+		}
+	}
+	return e
+}
+
+// Update starts the new file entries and stops the removed ones, a changed entry is
+// restarted from the position it has reached.
+func (e *Entries) Update(ctx context.Context, files []*define.AgentFile) {
+	e.mu.Lock()
+	keep := make(map[string]bool, len(files))
+	var starts []*define.AgentFile
+	var stopped []*entry
+	for _, cfg := range files {
+		key := cfg.Key()
+		keep[key] = true
+		if old := e.files[key]; old != nil {
+			if reflect.DeepEqual(old.cfg, cfg) {
+				continue
+			}
+			old.cancel()
+			stopped = append(stopped, old)
+		}
+		starts = append(starts, cfg)
+	}
+
+	for key, f := range e.files {
+		if !keep[key] {
+			e.cfg.Logger.Log(logger.LogLevelInfo, "%s stop %s", e.cfg.Name, key)
+			f.cancel()
+			delete(e.files, key)
+		}
+	}
+	e.mu.Unlock()
+
+	// the new pipeline starts where the old one stopped pushing lines, the old one takes
+	// the lock for its positions until it exits
+	for _, f := range stopped {
+		<-f.done
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, cfg := range starts {
+		e.start(ctx, cfg)
+	}
+}
+
+// Wait returns once the followers and pipelines of the stopped entries are gone.
+func (e *Entries) Wait() {
+	e.wg.Wait()
+}
+
+func (e *Entries) start(ctx context.Context, cfg *define.AgentFile) {
+	key := cfg.Key()
+	pl, err := NewPipeline(cfg)
+	if err != nil {
+		e.cfg.Logger.Log(logger.LogLevelError, "%s %s %v", e.cfg.Name, key, err)
+		return
+	}
+	// an entry without positions reads its files from the end
+	var positions map[string]Position
+	if len(e.positions[key]) > 0 {
+		positions = make(map[string]Position, len(e.positions[key]))
+		for path, pos := range e.positions[key] {
+			positions[path] = pos
+		}
+	}
+	e.cfg.Logger.Log(logger.LogLevelInfo, "%s start %s %s from %v", e.cfg.Name, key, cfg.Path, positions)
+
+	fileCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	e.files[key] = &entry{cfg: cfg, cancel: cancel, done: done}
+
+	follower := NewFollower(FollowConfig{
+		Pattern:     cfg.Path,
+		Positions:   positions,
+		Since:       e.cfg.Since,
+		MaxLineSize: pl.MaxLineSize(),
+		Logger:      e.cfg.Logger,
+		OnRotate: func(r Rotation) {
+			e.cfg.OnRotate(&define.AgentRotation{
+				Target:   cfg.Target,
+				Name:     cfg.Name,
+				Path:     r.Path,
+				Kind:     r.Kind,
+				OldInode: r.OldInode,
+				NewInode: r.NewInode,
+				Source:   r.Source,
+				Drained:  r.Drained,
+				Time:     r.Time.UnixNano(),
+			})
+		},
+	})
+
+	running := &sync.WaitGroup{}
+	running.Add(2)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		running.Wait()
+		close(done)
+	}()
+	go func() {
+		defer running.Done()
+		if err := follower.Run(fileCtx); err != nil {
+			e.cfg.Logger.Log(logger.LogLevelError, "%s %s read log file failed, %v", e.cfg.Name, key, err)
+		}
+	}()
+	go func() {
+		defer running.Done()
+		pl.Run(fileCtx, follower.Lines, func(line *Line, dropped bool) bool {
+			// a dropped line still moves the position forward
+			if !e.cfg.Emit(fileCtx, cfg, line, dropped) {
+				return false
+			}
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.setPosition(key, line.Path, line.Pos)
+			e.read[key]++
+			return true
+		})
+	}()
+}
+
+func (e *Entries) setPosition(key string, path string, pos Position) {
+	files := e.positions[key]
+	if files == nil {
+		files = make(map[string]Position)
+		e.positions[key] = files
+	}
+	files[path] = pos
+}
+
+// States reports the read positions and line counts of the running entries, dropped
+// counts the dropped lines of an entry.
+func (e *Entries) States(dropped func(key string) uint64) []*define.AgentFileState {
+	e.mu.Lock()
+	keys := make([]string, 0, len(e.files))
+	for key := range e.files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	states := make([]*define.AgentFileState, 0, len(keys))
+	for _, key := range keys {
+		cfg := e.files[key].cfg
+		state := &define.AgentFileState{
+			Target: cfg.Target,
+			Name:   cfg.Name,
+			Read:   e.read[key],
+		}
+		for path, pos := range e.positions[key] {
+			state.Positions = append(state.Positions, &define.AgentFilePosition{Path: path, Inode: pos.Inode, Offset: pos.Offset})
+		}
+		states = append(states, state)
+	}
+	e.mu.Unlock()
+
+	for i, state := range states {
+		state.Dropped = dropped(keys[i])
+		sort.Slice(state.Positions, func(i, j int) bool { return state.Positions[i].Path < state.Positions[j].Path })
+		for _, p := range state.Positions {
+			if info, err := os.Stat(p.Path); err == nil {
+				p.Size = info.Size()
+			}
+		}
+	}
+	return states
+}
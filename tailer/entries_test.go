@@ -0,0 +1,86 @@
+package tailer
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+	"github.com/lsg2020/logfilter/logger"
+)
+
+func startEntries(t *testing.T, resume map[string]map[string]Position) (*Entries, *testTailer) {
+	l, err := logger.NewLogger("test--->", logger.LogLevelError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := &testTailer{t: t, lines: make(chan *Line, 100)}
+	e := NewEntries(EntriesConfig{
+		Name:   "test",
+		Logger: l,
+		Emit: func(ctx context.Context, file *define.AgentFile, line *Line, dropped bool) bool {
+			select {
+			case tt.lines <- line:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		},
+		OnRotate: func(r *define.AgentRotation) {},
+	}, resume)
+	return e, tt
+}
+
+func TestEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeFile(t, path, "old\n")
+	file := &define.AgentFile{Target: "t", Name: "n", Path: path}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e, tt := startEntries(t, nil)
+	t.Cleanup(func() {
+		cancel()
+		e.Wait()
+	})
+
+	// an entry without positions starts at the end of its files
+	e.Update(ctx, []*define.AgentFile{file})
+	time.Sleep(time.Millisecond * 100)
+	appendFile(t, path, "a\n")
+	tt.expect("a")
+
+	// a changed entry goes on from its position
+	changed := *file
+	changed.MaxRecordSize = 100
+	e.Update(ctx, []*define.AgentFile{&changed})
+	appendFile(t, path, "b\n")
+	tt.expect("b")
+
+	states := e.States(func(key string) uint64 { return 0 })
+	if len(states) != 1 || states[0].Read != 2 || len(states[0].Positions) != 1 || states[0].Positions[0].Offset != 8 {
+		t.Fatalf("states %+v", states)
+	}
+
+	e.Update(ctx, nil)
+	if states := e.States(func(key string) uint64 { return 0 }); len(states) != 0 {
+		t.Errorf("states of removed entries %+v", states)
+	}
+}
+
+func TestEntriesResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeFile(t, path, "a\nb\n")
+	file := &define.AgentFile{Target: "t", Name: "n", Path: path}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e, tt := startEntries(t, map[string]map[string]Position{
+		file.Key(): {path: {Inode: inodeOf(t, path), Offset: 2}},
+	})
+	t.Cleanup(func() {
+		cancel()
+		e.Wait()
+	})
+	e.Update(ctx, []*define.AgentFile{file})
+	tt.expect("b")
+}
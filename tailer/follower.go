@@ -0,0 +1,262 @@
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	defaultScanInterval = time.Second * 10
+)
+
+// archive files are left to the rotation handling, they are never tailed as logs
+var archiveExts = []string{".gz", ".bz2", ".xz", ".zip", ".zst"}
+
+type FollowConfig struct {
+	// Pattern is a file path, a glob pattern or a directory
+	Pattern string
+	// Positions saved by the last run, nil on the first run
+	Positions map[string]Position
+	// Since is the time of the saved positions, files unchanged since then are read from the end
+	Since        time.Time
+	PollInterval time.Duration
+	ScanInterval time.Duration
+	MaxLineSize  int
+	Logger       logger.Log
+	// OnRotate is called for every rotation of the tailed files
+	OnRotate func(r Rotation)
+}
+
+// Follower tails every file matching a pattern and picks up new files as they appear.
+type Follower struct {
+	cfg   FollowConfig
+	Lines chan *Line
+
+	mu      sync.Mutex
+	tails   map[string]context.CancelFunc
+	current map[string]uint64
+	known   map[uint64]bool
+}
+
+func NewFollower(cfg FollowConfig) *Follower {
+	if cfg.ScanInterval <= 0 {
+		cfg.ScanInterval = defaultScanInterval
+	}
+	return &Follower{
+		cfg:     cfg,
+		Lines:   make(chan *Line, 1024),
+		tails:   make(map[string]context.CancelFunc),
+		current: make(map[string]uint64),
+		known:   make(map[uint64]bool),
+	}
+}
+
+// IsPattern reports whether path is a glob pattern rather than a plain path.
+func IsPattern(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// Match lists the log files of a pattern, a plain file path is returned as is even
+// before the file exists.
+func Match(pattern string) ([]string, error) {
+	var paths []string
+	if IsPattern(pattern) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s, %w", pattern, err)
+		}
+		paths = matches
+	} else {
+		info, err := os.Stat(pattern)
+		if err != nil || !info.IsDir() {
+			return []string{pattern}, nil
+		}
+		infos, err := ioutil.ReadDir(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("read dir %s failed, %w", pattern, err)
+		}
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			paths = append(paths, filepath.Join(pattern, info.Name()))
+		}
+	}
+
+	res := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if isArchive(path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		res = append(res, path)
+	}
+	return res, nil
+}
+
+func isArchive(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range archiveExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Run tails the matching files until ctx is done, Lines is closed when it returns.
+func (f *Follower) Run(ctx context.Context) error {
+	wg := &sync.WaitGroup{}
+	defer func() {
+		wg.Wait()
+		close(f.Lines)
+	}()
+
+	// files rotated away before the last run stopped keep the inode of a saved position
+	for path, pos := range f.cfg.Positions {
+		if info, err := os.Stat(path); err != nil || fileInode(info) != pos.Inode {
+			f.known[pos.Inode] = true
+		}
+	}
+
+	initial := true
+	ticker := time.NewTicker(f.cfg.ScanInterval)
+	defer ticker.Stop()
+	for {
+		if err := f.scan(ctx, wg, initial); err != nil {
+			f.log(logger.LogLevelError, "follow scan %s failed, %v", f.cfg.Pattern, err)
+		}
+		initial = false
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (f *Follower) log(lvl logger.LogLevel, format string, v ...interface{}) {
+	if f.cfg.Logger != nil {
+		f.cfg.Logger.Log(lvl, format, v...)
+	}
+}
+
+func (f *Follower) scan(ctx context.Context, wg *sync.WaitGroup, initial bool) error {
+	paths, err := Match(f.cfg.Pattern)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	matched := make(map[string]bool, len(paths))
+	inodes := make(map[uint64]bool, len(paths))
+	for _, path := range paths {
+		matched[path] = true
+		info, statErr := os.Stat(path)
+		if statErr == nil {
+			inodes[fileInode(info)] = true
+		}
+		if f.tails[path] != nil {
+			continue
+		}
+		// a rotated file of a path that is already tailed
+		if statErr == nil && f.known[fileInode(info)] {
+			continue
+		}
+		f.start(ctx, wg, path, f.startPosition(path, info, initial))
+	}
+
+	for path, cancel := range f.tails {
+		if matched[path] {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			f.log(logger.LogLevelInfo, "follow %s removed, stop tail", path)
+			cancel()
+			delete(f.tails, path)
+		}
+	}
+
+	for inode := range f.known {
+		if !inodes[inode] && !f.isCurrent(inode) {
+			delete(f.known, inode)
+		}
+	}
+	return nil
+}
+
+func (f *Follower) isCurrent(inode uint64) bool {
+	for _, current := range f.current {
+		if current == inode {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Follower) startPosition(path string, info os.FileInfo, initial bool) *Position {
+	if pos, ok := f.cfg.Positions[path]; ok {
+		return &pos
+	}
+	if info == nil {
+		// not created yet, everything written to it is new
+		return &Position{}
+	}
+	if initial && (f.cfg.Positions == nil || !info.ModTime().After(f.cfg.Since)) {
+		return nil
+	}
+	// a file created after the agent started is read from its beginning
+	return &Position{}
+}
+
+func (f *Follower) start(ctx context.Context, wg *sync.WaitGroup, path string, pos *Position) {
+	f.log(logger.LogLevelInfo, "follow start tail %s from %v", path, pos)
+
+	tailCtx, cancel := context.WithCancel(ctx)
+	f.tails[path] = cancel
+	t := New(Config{
+		Path:         path,
+		Position:     pos,
+		PollInterval: f.cfg.PollInterval,
+		MaxLineSize:  f.cfg.MaxLineSize,
+		Logger:       f.cfg.Logger,
+		OnRotate:     f.cfg.OnRotate,
+		OnOpen: func(path string, pos Position) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.current[path] = pos.Inode
+			f.known[pos.Inode] = true
+		},
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := t.Run(tailCtx, f.Lines)
+		if err != nil {
+			f.log(logger.LogLevelError, "follow tail %s failed, %v", path, err)
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.current, path)
+		if err != nil {
+			cancel()
+			delete(f.tails, path)
+		}
+	}()
+}
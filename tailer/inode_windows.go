@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package tailer
+
+import "os"
+
+// windows has no inode, rotation is only noticed by truncation there
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
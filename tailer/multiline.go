@@ -0,0 +1,115 @@
+package tailer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+const (
+	defaultMultilineMaxLines = 500
+	defaultMultilineFlush    = time.Second * 2
+)
+
+// Multiline assembles the physical lines of one event, an event ends when the next one
+// starts, when it reaches the max line count or when no line follows it in time.
+type Multiline struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	maxLines     int
+	timeout      time.Duration
+
+	lines []string
+	event *Line
+	last  time.Time
+}
+
+func NewMultiline(cfg *define.ConfigMultiline) (*Multiline, error) {
+	if cfg.Start == "" && cfg.Continuation == "" {
+		return nil, fmt.Errorf("multiline need start or continuation")
+	}
+
+	m := &Multiline{
+		maxLines: cfg.MaxLines,
+		timeout:  time.Duration(cfg.FlushMilliseconds) * time.Millisecond,
+	}
+	if m.maxLines <= 0 {
+		m.maxLines = defaultMultilineMaxLines
+	}
+	if m.timeout <= 0 {
+		m.timeout = defaultMultilineFlush
+	}
+
+	var err error
+	if cfg.Start != "" {
+		if m.start, err = regexp.Compile(cfg.Start); err != nil {
+			return nil, fmt.Errorf("multiline start invalid, %w", err)
+		}
+	}
+	if cfg.Continuation != "" {
+		if m.continuation, err = regexp.Compile(cfg.Continuation); err != nil {
+			return nil, fmt.Errorf("multiline continuation invalid, %w", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *Multiline) Timeout() time.Duration {
+	return m.timeout
+}
+
+// Add feeds the next physical line, it returns the events completed by it.
+func (m *Multiline) Add(line *Line) []*Line {
+	var events []*Line
+	if m.event != nil && !m.belongs(line.Text) {
+		events = append(events, m.finish())
+	}
+
+	if m.event == nil {
+		m.event = &Line{Time: line.Time, Offset: line.Offset}
+	}
+	m.lines = append(m.lines, line.Text)
+	m.event.Path = line.Path
+	m.event.Pos = line.Pos
+	m.event.Truncated += line.Truncated
+	m.last = line.Time
+
+	if len(m.lines) >= m.maxLines {
+		events = append(events, m.finish())
+	}
+	return events
+}
+
+// Flush returns the pending event once it waited longer than the flush timeout, or
+// at once when force is set.
+func (m *Multiline) Flush(now time.Time, force bool) *Line {
+	if m.event == nil {
+		return nil
+	}
+	if !force && now.Sub(m.last) < m.timeout {
+		return nil
+	}
+	return m.finish()
+}
+
+func (m *Multiline) belongs(text string) bool {
+	if m.continuation != nil && m.continuation.MatchString(text) {
+		return true
+	}
+	if m.start != nil {
+		// without a continuation rule every line up to the next start belongs to the event
+		return m.continuation == nil && !m.start.MatchString(text)
+	}
+	return false
+}
+
+func (m *Multiline) finish() *Line {
+	event := m.event
+	event.Text = strings.Join(m.lines, "\n")
+	m.event = nil
+	m.lines = m.lines[:0]
+	return event
+}
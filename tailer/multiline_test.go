@@ -0,0 +1,106 @@
+package tailer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+func TestMultiline(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    *define.ConfigMultiline
+		lines  []string
+		events []string
+		// the event left pending until it is flushed
+		pending string
+	}{
+		{
+			name:    "start",
+			cfg:     &define.ConfigMultiline{Start: `^\d{4}-`},
+			lines:   []string{"2022-01-01 a", "  at x", "  at y", "2022-01-01 b", "c"},
+			events:  []string{"2022-01-01 a\n  at x\n  at y"},
+			pending: "2022-01-01 b\nc",
+		},
+		{
+			name:    "continuation",
+			cfg:     &define.ConfigMultiline{Continuation: `^\s`},
+			lines:   []string{"a", " b", " c", "d", "e", " f"},
+			events:  []string{"a\n b\n c", "d"},
+			pending: "e\n f",
+		},
+		{
+			name:    "start and continuation",
+			cfg:     &define.ConfigMultiline{Start: `^\[`, Continuation: `^\s`},
+			lines:   []string{"[a", " b", "c", "[d"},
+			events:  []string{"[a\n b", "c"},
+			pending: "[d",
+		},
+		{
+			name:    "max lines",
+			cfg:     &define.ConfigMultiline{Continuation: `^\s`, MaxLines: 2},
+			lines:   []string{"a", " b", " c", " d", " e"},
+			events:  []string{"a\n b", " c\n d"},
+			pending: " e",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMultiline(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var events []string
+			for i, text := range tt.lines {
+				for _, event := range m.Add(&Line{Text: text, Offset: int64(i)}) {
+					events = append(events, event.Text)
+				}
+			}
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Errorf("events %q, want %q", events, tt.events)
+			}
+			if event := m.Flush(time.Now(), true); event == nil || event.Text != tt.pending {
+				t.Errorf("pending %v, want %q", event, tt.pending)
+			}
+		})
+	}
+}
+
+func TestMultilineFlush(t *testing.T) {
+	m, err := NewMultiline(&define.ConfigMultiline{Start: `^\[`, FlushMilliseconds: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	m.Add(&Line{Text: "[a", Offset: 10, Time: now})
+	m.Add(&Line{Text: "b", Offset: 13, Time: now, Truncated: 5})
+
+	if event := m.Flush(now.Add(time.Millisecond*50), false); event != nil {
+		t.Fatalf("flushed before timeout %q", event.Text)
+	}
+	event := m.Flush(now.Add(time.Millisecond*100), false)
+	if event == nil {
+		t.Fatal("not flushed after timeout")
+	}
+	if event.Text != "[a\nb" || event.Offset != 10 || event.Truncated != 5 {
+		t.Errorf("event %q offset:%d truncated:%d", event.Text, event.Offset, event.Truncated)
+	}
+	if event := m.Flush(now.Add(time.Second), true); event != nil {
+		t.Errorf("flushed twice %q", event.Text)
+	}
+}
+
+func TestNewMultilineInvalid(t *testing.T) {
+	for _, cfg := range []*define.ConfigMultiline{
+		{},
+		{Start: "("},
+		{Continuation: "["},
+	} {
+		if _, err := NewMultiline(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+// Pipeline turns the lines read from the log files of an entry into records, it decodes
+// them, joins the lines of multiline events, truncates them and checks the prefilter.
+type Pipeline struct {
+	file       *define.AgentFile
+	multilines map[string]*Multiline
+	prefilter  *Prefilter
+	transcoder *Transcoder
+}
+
+func NewPipeline(file *define.AgentFile) (*Pipeline, error) {
+	if file.Multiline != nil {
+		if _, err := NewMultiline(file.Multiline); err != nil {
+			return nil, fmt.Errorf("invalid multiline config, %w", err)
+		}
+	}
+	p := &Pipeline{file: file, multilines: make(map[string]*Multiline)}
+	if len(file.Prefilters) > 0 {
+		var err error
+		if p.prefilter, err = NewPrefilter(file.Prefilters); err != nil {
+			return nil, fmt.Errorf("invalid prefilter config, %w", err)
+		}
+	}
+	transcoder, err := NewTranscoder(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoding config, %w", err)
+	}
+	p.transcoder = transcoder
+	return p, nil
+}
+
+// MaxLineSize is the line size the follower of the entry reads.
+func (p *Pipeline) MaxLineSize() int {
+	return p.transcoder.MaxRecordSize()
+}
+
+// Run hands every record to emit until in is closed or ctx is done, a dropped record did
+// not pass the prefilter. It stops when emit returns false.
+func (p *Pipeline) Run(ctx context.Context, in <-chan *Line, emit func(line *Line, dropped bool) bool) {
+	var flushC <-chan time.Time
+	if p.file.Multiline != nil {
+		m, _ := NewMultiline(p.file.Multiline)
+		ticker := time.NewTicker(m.Timeout() / 2)
+		defer ticker.Stop()
+		flushC = ticker.C
+	}
+
+	record := func(line *Line) bool {
+		line.Text = strings.TrimSpace(line.Text)
+		if len(line.Text) == 0 {
+			return true
+		}
+		p.transcoder.Truncate(line)
+		return emit(line, p.prefilter != nil && !p.prefilter.Match(line.Text))
+	}
+	flush := func(now time.Time, force bool) bool {
+		for _, m := range p.multilines {
+			if event := m.Flush(now, force); event != nil {
+				if !record(event) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	for {
+		select {
+		case line, ok := <-in:
+			if !ok {
+				flush(time.Now(), true)
+				return
+			}
+			p.transcoder.Decode(line)
+			if p.file.Multiline == nil {
+				if !record(line) {
+					return
+				}
+				continue
+			}
+			if len(strings.TrimSpace(line.Text)) == 0 {
+				continue
+			}
+			for _, event := range p.getMultiline(line.Path).Add(line) {
+				if !record(event) {
+					return
+				}
+			}
+		case now := <-flushC:
+			if !flush(now, false) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getMultiline returns the assembler of a file, the events of different files never mix.
+func (p *Pipeline) getMultiline(path string) *Multiline {
+	m := p.multilines[path]
+	if m == nil {
+		m, _ = NewMultiline(p.file.Multiline)
+		p.multilines[path] = m
+	}
+	return m
+}
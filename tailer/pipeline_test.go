@@ -0,0 +1,87 @@
+package tailer
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    *define.AgentFile
+		lines   []*Line
+		records []string
+		dropped []bool
+	}{
+		{
+			name:    "plain",
+			file:    &define.AgentFile{},
+			lines:   []*Line{{Text: " a "}, {Text: ""}, {Text: "b"}},
+			records: []string{"a", "b"},
+			dropped: []bool{false, false},
+		},
+		{
+			name: "prefilter",
+			file: &define.AgentFile{Prefilters: []*define.ConfigPrefilter{{Levels: []string{"error"}}}},
+			lines: []*Line{
+				{Text: "INFO ok"},
+				{Text: "ERROR failed"},
+			},
+			records: []string{"INFO ok", "ERROR failed"},
+			dropped: []bool{true, false},
+		},
+		{
+			name: "multiline per file",
+			file: &define.AgentFile{Multiline: &define.ConfigMultiline{Start: `^\[`}},
+			lines: []*Line{
+				{Path: "a.log", Text: "[a1"},
+				{Path: "b.log", Text: "[b1"},
+				{Path: "a.log", Text: "a2"},
+				{Path: "b.log", Text: "b2"},
+				{Path: "a.log", Text: "[a3"},
+			},
+			records: []string{"[a1\na2", "[a3", "[b1\nb2"},
+			dropped: []bool{false, false, false},
+		},
+		{
+			name:    "decode then truncate",
+			file:    &define.AgentFile{Encoding: "gbk", MaxRecordSize: 4},
+			lines:   []*Line{{Text: "a\xd6\xd0\xce\xc4"}},
+			records: []string{"a中...[truncated 3 bytes]"},
+			dropped: []bool{false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPipeline(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in := make(chan *Line, len(tt.lines))
+			for _, line := range tt.lines {
+				in <- line
+			}
+			close(in)
+
+			var records []string
+			var dropped []bool
+			p.Run(context.Background(), in, func(line *Line, drop bool) bool {
+				records = append(records, line.Text)
+				dropped = append(dropped, drop)
+				return true
+			})
+			if tt.file.Multiline != nil {
+				// the pending events of the files are flushed in no order
+				sort.Strings(records)
+			}
+			if !reflect.DeepEqual(records, tt.records) || !reflect.DeepEqual(dropped, tt.dropped) {
+				t.Errorf("records %q dropped %v, want %q dropped %v", records, dropped, tt.records, tt.dropped)
+			}
+		})
+	}
+}
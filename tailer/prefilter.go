@@ -0,0 +1,55 @@
+package tailer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+// Prefilter keeps the lines wanted by any of the filters of a target, the rest is
+// dropped before it leaves the agent.
+type Prefilter struct {
+	contains []string
+	regexps  []*regexp.Regexp
+}
+
+func NewPrefilter(cfgs []*define.ConfigPrefilter) (*Prefilter, error) {
+	p := &Prefilter{}
+	for _, cfg := range cfgs {
+		if len(cfg.Contains) == 0 && len(cfg.Regexps) == 0 && len(cfg.Levels) == 0 {
+			return nil, fmt.Errorf("prefilter need contains, regexps or levels")
+		}
+		p.contains = append(p.contains, cfg.Contains...)
+		for _, expr := range cfg.Regexps {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("prefilter regexp invalid, %w", err)
+			}
+			p.regexps = append(p.regexps, re)
+		}
+		for _, level := range cfg.Levels {
+			re, err := regexp.Compile(`(?i)\b` + regexp.QuoteMeta(level) + `\b`)
+			if err != nil {
+				return nil, fmt.Errorf("prefilter level invalid, %w", err)
+			}
+			p.regexps = append(p.regexps, re)
+		}
+	}
+	return p, nil
+}
+
+func (p *Prefilter) Match(text string) bool {
+	for _, s := range p.contains {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
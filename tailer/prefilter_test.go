@@ -0,0 +1,52 @@
+package tailer
+
+import (
+	"testing"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+func TestPrefilter(t *testing.T) {
+	cfgs := []*define.ConfigPrefilter{
+		{Contains: []string{"timeout"}},
+		{Regexps: []string{`uid=\d+`}},
+		{Levels: []string{"ERROR", "warn"}},
+	}
+	p, err := NewPrefilter(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text  string
+		match bool
+	}{
+		{"read timeout after 3s", true},
+		{"read Timeout after 3s", false},
+		{"login uid=42", true},
+		{"login uid=", false},
+		{"[error] disk full", true},
+		{"Warn: slow query", true},
+		{"errors=0", false},
+		{"ERRORS found", false},
+		{"info started", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if match := p.Match(tt.text); match != tt.match {
+			t.Errorf("match %q = %v, want %v", tt.text, match, tt.match)
+		}
+	}
+}
+
+func TestNewPrefilterInvalid(t *testing.T) {
+	for _, cfgs := range [][]*define.ConfigPrefilter{
+		{{}},
+		{{Regexps: []string{"("}}},
+		{{Contains: []string{"a"}}, {}},
+	} {
+		if _, err := NewPrefilter(cfgs); err == nil {
+			t.Errorf("%+v accepted", cfgs)
+		}
+	}
+}
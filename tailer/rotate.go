@@ -0,0 +1,346 @@
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lsg2020/logfilter/logger"
+)
+
+// rotation kinds
+const (
+	// the file was renamed away and a new one created at its path
+	RotateRename = "rename"
+	// the file was copied away and truncated in place
+	RotateCopyTruncate = "copytruncate"
+	// the file was truncated in place and no copy of it was found
+	RotateTruncate = "truncate"
+	// the file was rotated while it was not tailed
+	RotateRestart = "restart"
+)
+
+const (
+	// bytes before the read position kept to recognize the file and its copies
+	fingerprintSize = 64
+	// a renamed file is drained until the writer has not touched it for this long
+	drainQuietTime = time.Second
+	drainMaxTime   = time.Second * 30
+	// newest rotated files checked for the copy of a truncated file
+	copyCandidates = 2
+)
+
+// rotated siblings of a log file, like app.log.1, app.log.2.gz, app.log.gz or app.log-20220101.gz
+var rotatedSuffix = regexp.MustCompile(`^(\.[0-9]+|-[0-9]{8,10})?(\.gz)?$`)
+
+// Rotation is a rotation of a tailed file, the rest of the old file is read from
+// Source before the tailer moves on to the new one.
+type Rotation struct {
+	Path     string
+	Kind     string
+	OldInode uint64
+	NewInode uint64
+	// the rotated file the rest was read from, empty when it was not found
+	Source string
+	// bytes read from the old file after the rotation was noticed
+	Drained int64
+	Time    time.Time
+}
+
+// Rotated lists the rotated siblings of a log file oldest first by their modification
+// time, logrotate keeps the time of a file when it renames or compresses it.
+func Rotated(path string) ([]string, error) {
+	var matches []string
+	for _, sep := range []string{".", "-"} {
+		m, err := filepath.Glob(escapeGlob(path) + sep + "*")
+		if err != nil {
+			return nil, fmt.Errorf("list rotated files failed, %w", err)
+		}
+		matches = append(matches, m...)
+	}
+
+	type rotated struct {
+		path    string
+		modTime time.Time
+	}
+	var files []*rotated
+	for _, match := range matches {
+		if !rotatedSuffix.MatchString(strings.TrimPrefix(match, path)) {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, &rotated{path: match, modTime: info.ModTime()})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.Before(files[j].modTime)
+		}
+		return files[i].path > files[j].path
+	})
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return paths, nil
+}
+
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// logFile is a log file read once from the start, a .gz file is read decompressed.
+type logFile struct {
+	io.Reader
+	file  *os.File
+	gz    *gzip.Reader
+	inode uint64
+}
+
+func openLog(path string) (*logFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("stat log file failed, %w", err)
+	}
+
+	lf := &logFile{Reader: f, file: f, inode: fileInode(info)}
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		switch {
+		case err == io.EOF:
+			lf.Reader = bytes.NewReader(nil)
+		case err != nil:
+			_ = f.Close()
+			return nil, fmt.Errorf("open gzip file failed, %w", err)
+		default:
+			lf.Reader, lf.gz = gz, gz
+		}
+	}
+	return lf, nil
+}
+
+// Skip moves n bytes forward from the start, it returns io.EOF when the file is shorter.
+func (f *logFile) Skip(n int64) error {
+	if f.Reader == io.Reader(f.file) {
+		info, err := f.file.Stat()
+		if err != nil {
+			return fmt.Errorf("stat log file failed, %w", err)
+		}
+		if n > info.Size() {
+			return io.EOF
+		}
+		if _, err := f.file.Seek(n, io.SeekStart); err != nil {
+			return fmt.Errorf("seek log file failed, %w", err)
+		}
+		return nil
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, f.Reader, n); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return fmt.Errorf("skip log file failed, %w", err)
+	}
+	return nil
+}
+
+func (f *logFile) Close() error {
+	if f.gz != nil {
+		_ = f.gz.Close()
+	}
+	return f.file.Close()
+}
+
+// isCopy reports whether a file holds the bytes read before offset.
+func isCopy(path string, offset int64, fingerprint []byte) bool {
+	if len(fingerprint) == 0 {
+		return false
+	}
+	f, err := openLog(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := f.Skip(offset - int64(len(fingerprint))); err != nil {
+		return false
+	}
+	buf := make([]byte, len(fingerprint))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, fingerprint)
+}
+
+func (t *Tailer) rotated(r Rotation) {
+	r.Path = t.cfg.Path
+	r.Time = time.Now()
+	t.log(logger.LogLevelInfo, "tail %s %s rotated, inode %d -> %d source:%s drained:%d", r.Path, r.Kind, r.OldInode, r.NewInode, r.Source, r.Drained)
+	if t.cfg.OnRotate != nil {
+		t.cfg.OnRotate(r)
+	}
+}
+
+// remember keeps the last bytes read as the fingerprint of the file.
+func (t *Tailer) remember(buf []byte) {
+	t.fingerprint = append(t.fingerprint, buf...)
+	if n := len(t.fingerprint); n > fingerprintSize {
+		t.fingerprint = append(t.fingerprint[:0], t.fingerprint[n-fingerprintSize:]...)
+	}
+}
+
+func (t *Tailer) loadFingerprint() {
+	t.fingerprint = t.fingerprint[:0]
+	size := int64(fingerprintSize)
+	if t.pos.Offset < size {
+		size = t.pos.Offset
+	}
+	if size == 0 {
+		return
+	}
+	buf := make([]byte, size)
+	if _, err := t.file.ReadAt(buf, t.pos.Offset-size); err == nil {
+		t.fingerprint = buf
+	}
+}
+
+// replaced reports whether the open file no longer holds the bytes read before the read
+// position, a copytruncate followed by new writes leaves the size beyond it.
+func (t *Tailer) replaced() bool {
+	if len(t.fingerprint) == 0 {
+		return false
+	}
+	buf := make([]byte, len(t.fingerprint))
+	if _, err := t.file.ReadAt(buf, t.pos.Offset-int64(len(buf))); err != nil {
+		return true
+	}
+	return !bytes.Equal(buf, t.fingerprint)
+}
+
+// drainOpen reads what the writer still adds to a renamed file, it stops once the file
+// has been quiet for a while.
+func (t *Tailer) drainOpen(ctx context.Context) (int64, error) {
+	begin := t.pos.Offset
+	started := time.Now()
+	lastData := started
+	for {
+		before := t.pos.Offset
+		if err := t.readLines(ctx); err != nil {
+			return t.pos.Offset - begin, err
+		}
+		now := time.Now()
+		if t.pos.Offset != before {
+			lastData = now
+		}
+		if now.Sub(lastData) >= drainQuietTime || now.Sub(started) >= drainMaxTime || !t.sleep(ctx) {
+			break
+		}
+	}
+	t.flushPartial(ctx)
+	return t.pos.Offset - begin, nil
+}
+
+// drainFile reads a rotated file from offset to its end, the lines keep the path of the
+// tailer and point inside the rotated file.
+func (t *Tailer) drainFile(ctx context.Context, path string, offset int64) (int64, error) {
+	f, err := openLog(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := f.Skip(offset); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	reader, pos, start, fingerprint := t.reader, t.pos, t.start, t.fingerprint
+	defer func() {
+		t.reader, t.pos, t.start, t.fingerprint = reader, pos, start, fingerprint
+	}()
+	t.reader = bufio.NewReader(f)
+	t.pos = Position{Inode: f.inode, Offset: offset}
+	t.fingerprint = nil
+	// an unfinished line of the tailed file goes on in its copy
+	if len(t.partial) == 0 && t.skipped == 0 {
+		t.start = offset
+	}
+	if err := t.readLines(ctx); err != nil {
+		return t.pos.Offset - offset, err
+	}
+	t.flushPartial(ctx)
+	return t.pos.Offset - offset, nil
+}
+
+// findCopy looks for the copy of a truncated file among the newest rotated files.
+func (t *Tailer) findCopy() string {
+	rotated, err := Rotated(t.cfg.Path)
+	if err != nil {
+		t.log(logger.LogLevelWarning, "tail %s list rotated files failed, %v", t.cfg.Path, err)
+		return ""
+	}
+	for i := len(rotated) - 1; i >= 0 && i >= len(rotated)-copyCandidates; i-- {
+		if isCopy(rotated[i], t.pos.Offset, t.fingerprint) {
+			return rotated[i]
+		}
+	}
+	return ""
+}
+
+// catchUp reads the files rotated away while the file was not tailed, from the saved
+// position in the file that was tailed through the newer rotated files.
+func (t *Tailer) catchUp(ctx context.Context, missed Position) error {
+	rotated, err := Rotated(t.cfg.Path)
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, path := range rotated {
+		if info, err := os.Stat(path); err == nil && fileInode(info) == missed.Inode {
+			index = i
+		}
+	}
+
+	r := Rotation{Kind: RotateRestart, OldInode: missed.Inode, NewInode: t.pos.Inode}
+	if index >= 0 {
+		r.Source = rotated[index]
+		for i, path := range rotated[index:] {
+			var offset int64
+			if i == 0 {
+				offset = missed.Offset
+			}
+			drained, err := t.drainFile(ctx, path, offset)
+			r.Drained += drained
+			if err != nil {
+				return fmt.Errorf("read rotated file %s failed, %w", path, err)
+			}
+		}
+	}
+	t.rotated(r)
+	return nil
+}
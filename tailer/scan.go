@@ -0,0 +1,110 @@
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ScanConfig selects the lines of a file read once from the start, a .gz file is read
+// decompressed and its offsets count the decompressed bytes. Zero bounds are open.
+type ScanConfig struct {
+	Path string
+	// byte range [FromOffset, ToOffset) of the line starts
+	FromOffset int64
+	ToOffset   int64
+	// line range [FromLine, ToLine] counted from 1
+	FromLine    int64
+	ToLine      int64
+	MaxLineSize int
+}
+
+// Scan calls fn with the lines of the file in the ranges, the last line is included
+// even without a line break.
+func Scan(ctx context.Context, cfg ScanConfig, fn func(line *Line) error) error {
+	f, err := openLog(cfg.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset, lineNo int64
+	skip := cfg.FromOffset > 0 && cfg.FromLine == 0 && cfg.ToLine == 0
+	if skip {
+		// skip to the line break before the range, the line around FromOffset starts before it
+		if err := f.Skip(cfg.FromOffset - 1); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		offset = cfg.FromOffset - 1
+	}
+	reader := bufio.NewReader(f)
+	if skip {
+		for {
+			buf, err := reader.ReadSlice('\n')
+			offset += int64(len(buf))
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("read log file failed, %w", err)
+			}
+			break
+		}
+	}
+
+	var partial []byte
+	var skipped int64
+	start := offset
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		buf, err := reader.ReadSlice('\n')
+		offset += int64(len(buf))
+		var cut int64
+		partial, cut = appendLine(partial, buf, cfg.MaxLineSize)
+		skipped += cut
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read log file failed, %w", err)
+		}
+		if err == io.EOF && len(partial) == 0 && skipped == 0 {
+			return nil
+		}
+
+		lineNo++
+		if (cfg.ToOffset > 0 && start >= cfg.ToOffset) || (cfg.ToLine > 0 && lineNo > cfg.ToLine) {
+			return nil
+		}
+		if start >= cfg.FromOffset && lineNo >= cfg.FromLine {
+			line := &Line{
+				Path:      cfg.Path,
+				Text:      string(bytes.TrimRight(partial, "\r\n")),
+				Offset:    start,
+				Pos:       Position{Inode: f.inode, Offset: offset},
+				Time:      time.Now(),
+				Truncated: skipped,
+			}
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		partial = partial[:0]
+		skipped = 0
+		start = offset
+	}
+}
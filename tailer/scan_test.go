@@ -0,0 +1,129 @@
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	// the lines start at 0, 6, 12, 18 and 24
+	content := "line1\nline2\nline3\nline4\nline5"
+	plain := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(plain, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte(content))
+	_ = w.Close()
+	compressed := filepath.Join(dir, "app.log.1.gz")
+	if err := ioutil.WriteFile(compressed, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     ScanConfig
+		lines   []string
+		offsets []int64
+	}{
+		{
+			name:    "all",
+			cfg:     ScanConfig{},
+			lines:   []string{"line1", "line2", "line3", "line4", "line5"},
+			offsets: []int64{0, 6, 12, 18, 24},
+		},
+		{
+			name:    "from line start",
+			cfg:     ScanConfig{FromOffset: 6},
+			lines:   []string{"line2", "line3", "line4", "line5"},
+			offsets: []int64{6, 12, 18, 24},
+		},
+		{
+			name:    "from inside a line",
+			cfg:     ScanConfig{FromOffset: 8},
+			lines:   []string{"line3", "line4", "line5"},
+			offsets: []int64{12, 18, 24},
+		},
+		{
+			name:    "offset range",
+			cfg:     ScanConfig{FromOffset: 6, ToOffset: 18},
+			lines:   []string{"line2", "line3"},
+			offsets: []int64{6, 12},
+		},
+		{
+			name:    "line range",
+			cfg:     ScanConfig{FromLine: 2, ToLine: 3},
+			lines:   []string{"line2", "line3"},
+			offsets: []int64{6, 12},
+		},
+		{
+			name:    "from line",
+			cfg:     ScanConfig{FromLine: 5},
+			lines:   []string{"line5"},
+			offsets: []int64{24},
+		},
+		{
+			name: "beyond end",
+			cfg:  ScanConfig{FromOffset: 100},
+		},
+		{
+			name:    "max line size",
+			cfg:     ScanConfig{ToLine: 2, MaxLineSize: 3},
+			lines:   []string{"lin", "lin"},
+			offsets: []int64{0, 6},
+		},
+	}
+
+	for _, path := range []string{plain, compressed} {
+		for _, tt := range tests {
+			t.Run(filepath.Base(path)+" "+tt.name, func(t *testing.T) {
+				cfg := tt.cfg
+				cfg.Path = path
+				var lines []string
+				var offsets []int64
+				err := Scan(context.Background(), cfg, func(line *Line) error {
+					lines = append(lines, line.Text)
+					offsets = append(offsets, line.Offset)
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(lines, tt.lines) || !reflect.DeepEqual(offsets, tt.offsets) {
+					t.Errorf("lines %q at %v, want %q at %v", lines, offsets, tt.lines, tt.offsets)
+				}
+			})
+		}
+	}
+}
+
+func TestScanTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := ioutil.WriteFile(path, []byte("abcdefgh\r\nij\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var lines []*Line
+	err := Scan(context.Background(), ScanConfig{Path: path, MaxLineSize: 4}, func(line *Line) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("lines %d, want 2", len(lines))
+	}
+	if lines[0].Text != "abcd" || lines[0].Truncated != 4 || lines[0].Pos.Offset != 10 {
+		t.Errorf("line %q truncated:%d pos:%d", lines[0].Text, lines[0].Truncated, lines[0].Pos.Offset)
+	}
+	if lines[1].Text != "ij" || lines[1].Truncated != 0 || lines[1].Offset != 10 {
+		t.Errorf("line %q truncated:%d offset:%d", lines[1].Text, lines[1].Truncated, lines[1].Offset)
+	}
+}
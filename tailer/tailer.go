@@ -0,0 +1,314 @@
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lsg2020/logfilter/logger"
+)
+
+const (
+	defaultPollInterval = time.Millisecond * 250
+)
+
+// Position is a read position inside a log file, the inode tells rotated files apart.
+type Position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Line is one complete line of the log file, Offset is where it starts and Pos points
+// right after its line break.
+type Line struct {
+	Path   string
+	Text   string
+	Offset int64
+	Pos    Position
+	Time   time.Time
+	// bytes cut off the line by the max line size
+	Truncated int64
+}
+
+type Config struct {
+	Path string
+	// Position to resume from, nil starts at the end of the file
+	Position     *Position
+	PollInterval time.Duration
+	Logger       logger.Log
+	// MaxLineSize bounds the bytes kept of a line, the rest is skipped up to the line break
+	MaxLineSize int
+	// OnOpen is called every time a file is opened at path
+	OnOpen func(path string, pos Position)
+	// OnRotate is called after the rest of a rotated file is read
+	OnRotate func(r Rotation)
+}
+
+// Tailer follows a log file by polling, it resumes from a saved position and
+// notices when the file is rotated or truncated.
+type Tailer struct {
+	cfg Config
+	out chan<- *Line
+
+	file        *os.File
+	reader      *bufio.Reader
+	pos         Position
+	partial     []byte
+	skipped     int64
+	start       int64
+	fingerprint []byte
+	// the saved position of a file rotated away before the tailer started
+	missed *Position
+}
+
+func New(cfg Config) *Tailer {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	return &Tailer{
+		cfg: cfg,
+	}
+}
+
+// Run reads the file into out until ctx is done.
+func (t *Tailer) Run(ctx context.Context, out chan<- *Line) error {
+	t.out = out
+	defer t.close()
+
+	for {
+		err := t.open(t.cfg.Position)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if !t.sleep(ctx) {
+			return nil
+		}
+	}
+	if t.missed != nil {
+		if err := t.catchUp(ctx, *t.missed); err != nil {
+			t.log(logger.LogLevelError, "tail %s catch up rotated files failed, %v", t.cfg.Path, err)
+		}
+		t.missed = nil
+	}
+
+	for {
+		// the file is checked before reading, a copytruncate followed by new writes
+		// would otherwise be read from the old position
+		if err := t.checkFile(ctx); err != nil {
+			return err
+		}
+		if err := t.readLines(ctx); err != nil {
+			return err
+		}
+		if ctx.Err() != nil || !t.sleep(ctx) {
+			return nil
+		}
+	}
+}
+
+func (t *Tailer) log(lvl logger.LogLevel, format string, v ...interface{}) {
+	if t.cfg.Logger != nil {
+		t.cfg.Logger.Log(lvl, format, v...)
+	}
+}
+
+func (t *Tailer) sleep(ctx context.Context) bool {
+	timer := time.NewTimer(t.cfg.PollInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (t *Tailer) open(resume *Position) error {
+	f, err := os.Open(t.cfg.Path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat log file failed, %w", err)
+	}
+
+	pos := Position{Inode: fileInode(info)}
+	switch {
+	case resume == nil:
+		pos.Offset = info.Size()
+	case resume.Offset == 0:
+	case resume.Inode != pos.Inode:
+		t.log(logger.LogLevelInfo, "tail %s rotated since %v, read from start", t.cfg.Path, *resume)
+		missed := *resume
+		t.missed = &missed
+	case resume.Offset > info.Size():
+		t.log(logger.LogLevelInfo, "tail %s truncated since %v, read from start", t.cfg.Path, *resume)
+	default:
+		pos.Offset = resume.Offset
+	}
+
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("seek log file failed, %w", err)
+	}
+
+	t.close()
+	t.file = f
+	t.reader = bufio.NewReader(f)
+	t.pos = pos
+	t.start = pos.Offset
+	t.partial = t.partial[:0]
+	t.skipped = 0
+	t.loadFingerprint()
+	if t.cfg.OnOpen != nil {
+		t.cfg.OnOpen(t.cfg.Path, pos)
+	}
+	return nil
+}
+
+func (t *Tailer) close() {
+	if t.file != nil {
+		_ = t.file.Close()
+		t.file = nil
+	}
+}
+
+func (t *Tailer) readLines(ctx context.Context) error {
+	for {
+		buf, err := t.reader.ReadSlice('\n')
+		if len(buf) > 0 {
+			// an unfinished line is kept until its line break is written
+			t.pos.Offset += int64(len(buf))
+			t.appendPartial(buf)
+			t.remember(buf)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read log file failed, %w", err)
+		}
+
+		if !t.emit(ctx) {
+			return nil
+		}
+	}
+}
+
+// flushPartial emits the unfinished line at the end of a file that is left behind.
+func (t *Tailer) flushPartial(ctx context.Context) {
+	if len(t.partial) > 0 || t.skipped > 0 {
+		t.emit(ctx)
+	}
+}
+
+func (t *Tailer) emit(ctx context.Context) bool {
+	line := &Line{
+		Path:      t.cfg.Path,
+		Text:      string(bytes.TrimRight(t.partial, "\r\n")),
+		Offset:    t.start,
+		Pos:       t.pos,
+		Time:      time.Now(),
+		Truncated: t.skipped,
+	}
+	t.partial = t.partial[:0]
+	t.skipped = 0
+	t.start = t.pos.Offset
+	select {
+	case t.out <- line:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (t *Tailer) appendPartial(buf []byte) {
+	var skipped int64
+	t.partial, skipped = appendLine(t.partial, buf, t.cfg.MaxLineSize)
+	t.skipped += skipped
+}
+
+// appendLine appends the bytes read to a line of at most max bytes, it returns the
+// count of the bytes cut off without the line break.
+func appendLine(line []byte, buf []byte, max int) ([]byte, int64) {
+	var skipped int64
+	if max > 0 && len(line)+len(buf) > max {
+		keep := max - len(line)
+		if keep < 0 {
+			keep = 0
+		}
+		skipped = int64(len(bytes.TrimRight(buf[keep:], "\r\n")))
+		buf = buf[:keep]
+	}
+	return append(line, buf...), skipped
+}
+
+// checkFile compares the open file with the one at path. A file renamed away is drained
+// before the path is reopened, a file truncated in place is rewound after the rest is
+// read from its copy when logrotate copytruncate made one.
+func (t *Tailer) checkFile(ctx context.Context) error {
+	info, err := os.Stat(t.cfg.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat log file failed, %w", err)
+	}
+
+	if fileInode(info) != t.pos.Inode {
+		old := t.pos.Inode
+		// drain what is written to the old file until its writer moves on
+		drained, err := t.drainOpen(ctx)
+		if err != nil {
+			return err
+		}
+		r := Rotation{Kind: RotateRename, OldInode: old, NewInode: fileInode(info), Drained: drained}
+		if rotated, err := Rotated(t.cfg.Path); err == nil {
+			for _, path := range rotated {
+				if info, err := os.Stat(path); err == nil && fileInode(info) == old {
+					r.Source = path
+				}
+			}
+		}
+		if err := t.open(&Position{Inode: fileInode(info)}); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		t.rotated(r)
+		return nil
+	}
+
+	if info.Size() < t.pos.Offset || t.replaced() {
+		r := Rotation{Kind: RotateTruncate, OldInode: t.pos.Inode, NewInode: t.pos.Inode}
+		if source := t.findCopy(); source != "" {
+			drained, err := t.drainFile(ctx, source, t.pos.Offset)
+			if err != nil {
+				t.log(logger.LogLevelError, "tail %s read copy %s failed, %v", t.cfg.Path, source, err)
+			}
+			r.Kind, r.Source, r.Drained = RotateCopyTruncate, source, drained
+		}
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek log file failed, %w", err)
+		}
+		t.reader.Reset(t.file)
+		t.pos.Offset = 0
+		t.start = 0
+		t.partial = t.partial[:0]
+		t.skipped = 0
+		t.fingerprint = t.fingerprint[:0]
+		t.rotated(r)
+		return nil
+	}
+	return nil
+}
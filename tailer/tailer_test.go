@@ -0,0 +1,251 @@
+package tailer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAppendLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		buf     string
+		max     int
+		want    string
+		skipped int64
+	}{
+		{"", "abc\n", 0, "abc\n", 0},
+		{"", "abc\n", 8, "abc\n", 0},
+		{"", "abcdef\n", 4, "abcd", 2},
+		{"", "abcdef\r\n", 4, "abcd", 2},
+		{"ab", "cdef\n", 4, "abcd", 2},
+		{"abcd", "ef\n", 4, "abcd", 2},
+		{"abcd", "\n", 4, "abcd", 0},
+	}
+	for _, tt := range tests {
+		line, skipped := appendLine([]byte(tt.line), []byte(tt.buf), tt.max)
+		if string(line) != tt.want || skipped != tt.skipped {
+			t.Errorf("append %q to %q max:%d = %q skipped:%d, want %q skipped:%d", tt.buf, tt.line, tt.max, line, skipped, tt.want, tt.skipped)
+		}
+	}
+}
+
+// testTailer runs a tailer of path and collects its lines and rotations.
+type testTailer struct {
+	t      *testing.T
+	lines  chan *Line
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	rotations []Rotation
+}
+
+func startTailer(t *testing.T, path string, pos *Position) *testTailer {
+	ctx, cancel := context.WithCancel(context.Background())
+	tt := &testTailer{t: t, lines: make(chan *Line, 100), cancel: cancel, done: make(chan struct{})}
+	tailer := New(Config{
+		Path:         path,
+		Position:     pos,
+		PollInterval: time.Millisecond * 10,
+		OnRotate: func(r Rotation) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.rotations = append(tt.rotations, r)
+		},
+	})
+	go func() {
+		defer close(tt.done)
+		if err := tailer.Run(ctx, tt.lines); err != nil {
+			t.Errorf("tail %s failed, %v", path, err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-tt.done
+	})
+	return tt
+}
+
+// expect waits for the next lines of the tailer.
+func (tt *testTailer) expect(want ...string) {
+	tt.t.Helper()
+	var got []string
+	timeout := time.After(time.Second * 5)
+	for len(got) < len(want) {
+		select {
+		case line := <-tt.lines:
+			got = append(got, line.Text)
+		case <-timeout:
+			tt.t.Fatalf("lines %q, want %q", got, want)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		tt.t.Fatalf("lines %q, want %q", got, want)
+	}
+}
+
+func (tt *testTailer) rotation() Rotation {
+	tt.t.Helper()
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if len(tt.rotations) != 1 {
+		tt.t.Fatalf("rotations %+v, want one", tt.rotations)
+	}
+	return tt.rotations[0]
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendFile(t *testing.T, path string, content string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func inodeOf(t *testing.T, path string) uint64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileInode(info)
+}
+
+func TestTailerFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeFile(t, path, "a\nb\n")
+	tt := startTailer(t, path, &Position{})
+	tt.expect("a", "b")
+
+	// an unfinished line waits for its line break
+	appendFile(t, path, "c")
+	time.Sleep(time.Millisecond * 50)
+	appendFile(t, path, "d\r\ne\n")
+	tt.expect("cd", "e")
+}
+
+func TestTailerTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeFile(t, path, "aaaa\nbbbb\n")
+	tt := startTailer(t, path, &Position{})
+	tt.expect("aaaa", "bbbb")
+
+	writeFile(t, path, "c\n")
+	tt.expect("c")
+	if r := tt.rotation(); r.Kind != RotateTruncate {
+		t.Errorf("rotation %+v, want truncate", r)
+	}
+}
+
+func TestTailerCopyTruncate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	writeFile(t, path, "a\nb\n")
+	tt := startTailer(t, path, &Position{})
+	tt.expect("a", "b")
+
+	// the line written right before the copy is read from the copy
+	appendFile(t, path, "c\n")
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path+".1", string(buf))
+	writeFile(t, path, "d\n")
+	tt.expect("c", "d")
+	if r := tt.rotation(); r.Kind != RotateCopyTruncate || r.Source != path+".1" {
+		t.Errorf("rotation %+v, want copytruncate from %s.1", r, path)
+	}
+}
+
+func TestTailerRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	writeFile(t, path, "a\n")
+	tt := startTailer(t, path, &Position{})
+	tt.expect("a")
+
+	old := inodeOf(t, path)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	// the writer still appends to the renamed file before it reopens the path
+	appendFile(t, path+".1", "b\n")
+	writeFile(t, path, "c\n")
+	tt.expect("b", "c")
+	r := tt.rotation()
+	if r.Kind != RotateRename || r.OldInode != old || r.Source != path+".1" {
+		t.Errorf("rotation %+v, want rename of %d from %s.1", r, old, path)
+	}
+}
+
+func TestTailerResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	writeFile(t, path, "a\nb\n")
+	inode := inodeOf(t, path)
+
+	tests := []struct {
+		name string
+		pos  *Position
+		want []string
+	}{
+		{"saved position", &Position{Inode: inode, Offset: 2}, []string{"b"}},
+		{"truncated since", &Position{Inode: inode, Offset: 100}, []string{"a", "b"}},
+		{"no position", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tt := startTailer(t, path, test.pos)
+			tt.expect(test.want...)
+			select {
+			case line := <-tt.lines:
+				t.Errorf("unexpected line %q", line.Text)
+			case <-time.After(time.Millisecond * 50):
+			}
+		})
+	}
+}
+
+func TestTailerResumeRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	writeFile(t, path, "a\nb\n")
+	old := inodeOf(t, path)
+
+	// rotated twice while it was not tailed
+	if err := os.Rename(path, path+".2"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".2", "c\n")
+	writeFile(t, path+".1", "d\n")
+	past := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path+".2", past, past); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, "e\n")
+
+	tt := startTailer(t, path, &Position{Inode: old, Offset: 2})
+	tt.expect("b", "c", "d", "e")
+	r := tt.rotation()
+	if r.Kind != RotateRestart || r.Source != path+".2" || r.Drained != 6 {
+		t.Errorf("rotation %+v, want restart from %s.2", r, path)
+	}
+}
@@ -0,0 +1,51 @@
+package tailer
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/lsg2020/logfilter/define"
+)
+
+// Timestamp parses the time of a record with a pattern and a go time layout.
+type Timestamp struct {
+	re     *regexp.Regexp
+	layout string
+}
+
+func NewTimestamp(cfg *define.ConfigTimestamp) (*Timestamp, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp pattern %s invalid, %w", cfg.Pattern, err)
+	}
+	return &Timestamp{re: re, layout: cfg.Layout}, nil
+}
+
+// Parse returns false for a record without a timestamp. A layout without a year, like
+// the syslog one, gets the latest year that does not put the time in the future.
+func (t *Timestamp) Parse(text string) (time.Time, bool) {
+	m := t.re.FindStringSubmatch(text)
+	if m == nil {
+		return time.Time{}, false
+	}
+	s := m[0]
+	if len(m) > 1 {
+		s = m[1]
+	}
+	tm, err := time.ParseInLocation(t.layout, s, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if tm.Year() == 0 {
+		now := time.Now()
+		tm = tm.AddDate(now.Year(), 0, 0)
+		if tm.After(now.Add(time.Hour * 24)) {
+			tm = tm.AddDate(-1, 0, 0)
+		}
+	}
+	return tm, true
+}